@@ -0,0 +1,194 @@
+package workload
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rancher/norman/types"
+	"github.com/rancher/norman/types/convert"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	maxUpdateConflictAttempts = 5
+	updateConflictBaseBackoff = 100 * time.Millisecond
+
+	attemptsHeader = "X-Workload-Update-Attempts"
+)
+
+var workloadUpdateConflictsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "workload_update_conflicts_total",
+	Help: "Number of times CustomizeStore.Update retried after losing an optimistic-concurrency race.",
+})
+
+func init() {
+	prometheus.MustRegister(workloadUpdateConflictsTotal)
+}
+
+// update retries s.Store.Update against apierrors.IsConflict, which
+// norman's backing store surfaces whenever Kubernetes rejects a write
+// because the resourceVersion in data is stale. On each conflict it
+// re-reads the current object via ByID, replays the mutating transforms
+// against it, and resubmits - capped at maxUpdateConflictAttempts with
+// exponential backoff.
+//
+// The reconciliation is a real 3-way merge, not a 2-way diff against the
+// post-conflict read: base is read via ByID before the first Update
+// attempt, so it reflects the object as the caller actually started
+// editing it. userChanged (diffKeys(base, original)) is therefore the
+// set of fields the caller itself touched, independent of anything a
+// concurrent writer did. On conflict, mergeUserChanges starts from fresh
+// (the server's newer state) and overlays only those fields, so an
+// unrelated field changed by a concurrent writer - one base and fresh
+// agree the caller never touched - is never clobbered. Where a field was
+// both user-changed and concurrently changed, the caller's intent still
+// wins, consistent with this being a user-initiated write; logConflicts
+// logs those true conflicts for visibility. The mustCheckData fast path
+// skips reconciliation entirely when the conflict turns out to be stale:
+// if data's resourceVersion already matches what ByID just read, there's
+// nothing to merge and the caller's data can be resubmitted as-is.
+func (s *CustomizeStore) update(apiContext *types.APIContext, schema *types.Schema, splitted []string, id string, data map[string]interface{}) (map[string]interface{}, error) {
+	// original must be captured before updateOnce runs, since updateOnce's
+	// transforms (resolveImages, setPorts, setScheduling, ...) mutate data
+	// and its nested maps in place - diffing against an aliased original
+	// would make every transformed field look user-changed and defeat
+	// mergeUserChanges on retry.
+	original, err := deepCopyData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// base is the object as it stood before this edit began, used as the
+	// common ancestor for the 3-way merge below. It must be read before
+	// the first Update attempt, not only after a conflict, or there is no
+	// way to tell a field the caller changed from one a concurrent writer
+	// changed.
+	base, err := s.Store.ByID(apiContext, schema, id)
+	if err != nil {
+		return nil, err
+	}
+	userChanged := diffKeys(base, original)
+
+	// applyStrategy runs once, outside the retry loop below: for
+	// BlueGreen/Canary it drives one-shot cluster side effects (creating
+	// the green Deployment, flipping the Service selector, pausing the
+	// Deployment to scale ReplicaSets) that must not be replayed every
+	// time updateOnce loses an optimistic-concurrency race.
+	if err := applyStrategy(apiContext, s.manager, id, data); err != nil {
+		return nil, err
+	}
+
+	var (
+		result  map[string]interface{}
+		attempt int
+	)
+
+	for attempt = 1; attempt <= maxUpdateConflictAttempts; attempt++ {
+		result, err = s.updateOnce(apiContext, schema, splitted, id, data)
+		if err == nil || !apierrors.IsConflict(err) || attempt == maxUpdateConflictAttempts {
+			break
+		}
+
+		workloadUpdateConflictsTotal.Inc()
+
+		fresh, readErr := s.Store.ByID(apiContext, schema, id)
+		if readErr != nil {
+			return nil, readErr
+		}
+
+		if !mustCheckData(original, fresh) {
+			logConflicts(id, userChanged, diffKeys(base, fresh))
+			data = mergeUserChanges(fresh, original, userChanged)
+		}
+
+		time.Sleep(updateConflictBackoff(attempt))
+	}
+
+	if apiContext.Response != nil {
+		apiContext.Response.Header().Set(attemptsHeader, strconv.Itoa(attempt))
+	}
+	return result, err
+}
+
+func (s *CustomizeStore) updateOnce(apiContext *types.APIContext, schema *types.Schema, splitted []string, id string, data map[string]interface{}) (map[string]interface{}, error) {
+	if err := s.resolveImages(apiContext, data); err != nil {
+		return nil, err
+	}
+	if err := s.setPorts(splitted[1], data); err != nil {
+		return nil, err
+	}
+	setScheduling(apiContext, data)
+	return s.Store.Update(apiContext, schema, data, id)
+}
+
+// deepCopyData returns an independent copy of data, including nested maps
+// and slices (e.g. containers, annotations), via a JSON round-trip.
+func deepCopyData(data map[string]interface{}) (map[string]interface{}, error) {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	copied := map[string]interface{}{}
+	if err := json.Unmarshal(content, &copied); err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
+
+// mustCheckData reports whether data's resourceVersion already matches
+// the object ByID just read, meaning the conflict we hit wasn't caused
+// by data going stale and there is nothing to reconcile.
+func mustCheckData(data, fresh map[string]interface{}) bool {
+	rv := convert.ToString(data["resourceVersion"])
+	return rv != "" && rv == convert.ToString(fresh["resourceVersion"])
+}
+
+// diffKeys returns the set of top-level keys where changed differs from
+// base - a shallow JSON-merge diff good enough for norman's flat
+// map[string]interface{} resource representation.
+func diffKeys(base, changed map[string]interface{}) map[string]bool {
+	diff := map[string]bool{}
+	for k, v := range changed {
+		if !reflect.DeepEqual(v, base[k]) {
+			diff[k] = true
+		}
+	}
+	return diff
+}
+
+// logConflicts warns about fields that are both user-changed and
+// concurrentlyChanged: mergeUserChanges resolves these in the caller's
+// favor, which is usually correct for a user-initiated write, but is
+// worth surfacing since it silently discards a concurrent writer's edit
+// to the same field.
+func logConflicts(id string, userChanged, concurrentlyChanged map[string]bool) {
+	for k := range userChanged {
+		if concurrentlyChanged[k] {
+			logrus.Warnf("workload %s: field %q was changed both by this request and concurrently on the server; keeping this request's value", id, k)
+		}
+	}
+}
+
+// mergeUserChanges starts from fresh (the server's newer state) and
+// overlays the keys the user explicitly changed with their original
+// values from data.
+func mergeUserChanges(fresh, data map[string]interface{}, userChanged map[string]bool) map[string]interface{} {
+	merged := make(map[string]interface{}, len(fresh))
+	for k, v := range fresh {
+		merged[k] = v
+	}
+	for k := range userChanged {
+		merged[k] = data[k]
+	}
+	// always resubmit against the latest resourceVersion
+	merged["resourceVersion"] = fresh["resourceVersion"]
+	return merged
+}
+
+func updateConflictBackoff(attempt int) time.Duration {
+	return updateConflictBaseBackoff * time.Duration(uint(1)<<uint(attempt-1))
+}
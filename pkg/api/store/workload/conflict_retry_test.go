@@ -0,0 +1,179 @@
+package workload
+
+import (
+	"testing"
+
+	"github.com/rancher/norman/types"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// fakeConflictStore is the test double for types.Store that update and
+// updateOnce need: it replays ByID and Update responses in call order and
+// records every data map Update is invoked with, so a test can assert on
+// exactly what was resubmitted after a merge.
+type fakeConflictStore struct {
+	types.Store
+
+	byIDResponses []map[string]interface{}
+	byIDCalls     int
+
+	updateResults []map[string]interface{}
+	updateErrs    []error
+	updateCalls   int
+	updateSeen    []map[string]interface{}
+}
+
+func (f *fakeConflictStore) ByID(apiContext *types.APIContext, schema *types.Schema, id string) (map[string]interface{}, error) {
+	i := f.byIDCalls
+	if i >= len(f.byIDResponses) {
+		i = len(f.byIDResponses) - 1
+	}
+	f.byIDCalls++
+	return deepCopyData(f.byIDResponses[i])
+}
+
+func (f *fakeConflictStore) Update(apiContext *types.APIContext, schema *types.Schema, data map[string]interface{}, id string) (map[string]interface{}, error) {
+	copied, err := deepCopyData(data)
+	if err != nil {
+		return nil, err
+	}
+	f.updateSeen = append(f.updateSeen, copied)
+
+	i := f.updateCalls
+	if i >= len(f.updateResults) {
+		i = len(f.updateResults) - 1
+	}
+	f.updateCalls++
+	return f.updateResults[i], f.updateErrs[i]
+}
+
+// newConflictTestStore wires store straight into CustomizeStore.Store
+// with no other Options: update and updateOnce only need ByID/Update,
+// and resolveImages/setPorts are no-ops when data has no containers.
+func newConflictTestStore(store types.Store) *CustomizeStore {
+	return &CustomizeStore{Store: store}
+}
+
+var conflictErr = apierrors.NewConflict(schema.GroupResource{Resource: "deployments"}, "testworkload", nil)
+
+// TestUpdateConcurrentEditToUntouchedFieldSurvivesRetry is the regression
+// test for the bug a 2-way diff(fresh, original) has: a concurrent
+// writer's change to fieldB, which the caller never touched, must not be
+// overwritten with the stale value from original once the retry
+// resubmits.
+func TestUpdateConcurrentEditToUntouchedFieldSurvivesRetry(t *testing.T) {
+	base := map[string]interface{}{
+		"id":              "testns:testworkload",
+		"resourceVersion": "1",
+		"fieldA":          "base-a",
+		"fieldB":          "base-b",
+	}
+	fresh := map[string]interface{}{
+		"id":              "testns:testworkload",
+		"resourceVersion": "2",
+		"fieldA":          "base-a",
+		"fieldB":          "concurrent-b",
+	}
+	data := map[string]interface{}{
+		"id":              "testns:testworkload",
+		"resourceVersion": "1",
+		"fieldA":          "user-a",
+		"fieldB":          "base-b",
+	}
+
+	store := &fakeConflictStore{
+		byIDResponses: []map[string]interface{}{base, fresh},
+		updateResults: []map[string]interface{}{nil, {"id": "testns:testworkload"}},
+		updateErrs:    []error{conflictErr, nil},
+	}
+	s := newConflictTestStore(store)
+
+	if _, err := s.update(&types.APIContext{}, &types.Schema{}, []string{"testns", "testworkload"}, "testns:testworkload", data); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	if store.updateCalls != 2 {
+		t.Fatalf("Update called %d times, want 2", store.updateCalls)
+	}
+	resubmitted := store.updateSeen[1]
+	if resubmitted["fieldB"] != "concurrent-b" {
+		t.Errorf("fieldB = %v, want concurrent-b (the concurrent writer's value must survive)", resubmitted["fieldB"])
+	}
+	if resubmitted["fieldA"] != "user-a" {
+		t.Errorf("fieldA = %v, want user-a (the caller's own change must survive)", resubmitted["fieldA"])
+	}
+	if resubmitted["resourceVersion"] != "2" {
+		t.Errorf("resourceVersion = %v, want 2 (must resubmit against the latest)", resubmitted["resourceVersion"])
+	}
+}
+
+// TestUpdateTrueConflictFavorsCallerIntent covers the case where the same
+// field was changed both by the caller and concurrently on the server:
+// the caller's own write should still win, per this store's documented
+// merge policy.
+func TestUpdateTrueConflictFavorsCallerIntent(t *testing.T) {
+	base := map[string]interface{}{
+		"id":              "testns:testworkload",
+		"resourceVersion": "1",
+		"fieldA":          "base-a",
+	}
+	fresh := map[string]interface{}{
+		"id":              "testns:testworkload",
+		"resourceVersion": "2",
+		"fieldA":          "other-writer-a",
+	}
+	data := map[string]interface{}{
+		"id":              "testns:testworkload",
+		"resourceVersion": "1",
+		"fieldA":          "user-a",
+	}
+
+	store := &fakeConflictStore{
+		byIDResponses: []map[string]interface{}{base, fresh},
+		updateResults: []map[string]interface{}{nil, {"id": "testns:testworkload"}},
+		updateErrs:    []error{conflictErr, nil},
+	}
+	s := newConflictTestStore(store)
+
+	if _, err := s.update(&types.APIContext{}, &types.Schema{}, []string{"testns", "testworkload"}, "testns:testworkload", data); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	resubmitted := store.updateSeen[1]
+	if resubmitted["fieldA"] != "user-a" {
+		t.Errorf("fieldA = %v, want user-a (caller's intent should win a true conflict)", resubmitted["fieldA"])
+	}
+}
+
+// TestUpdateSkipsMergeWhenConflictWasStale covers the mustCheckData fast
+// path: if data's resourceVersion already matches the object ByID just
+// read, there's nothing to reconcile and data is resubmitted unchanged.
+func TestUpdateSkipsMergeWhenConflictWasStale(t *testing.T) {
+	base := map[string]interface{}{
+		"id":              "testns:testworkload",
+		"resourceVersion": "1",
+		"fieldA":          "base-a",
+	}
+	data := map[string]interface{}{
+		"id":              "testns:testworkload",
+		"resourceVersion": "1",
+		"fieldA":          "user-a",
+	}
+
+	store := &fakeConflictStore{
+		byIDResponses: []map[string]interface{}{base, base},
+		updateResults: []map[string]interface{}{nil, {"id": "testns:testworkload"}},
+		updateErrs:    []error{conflictErr, nil},
+	}
+	s := newConflictTestStore(store)
+
+	if _, err := s.update(&types.APIContext{}, &types.Schema{}, []string{"testns", "testworkload"}, "testns:testworkload", data); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	resubmitted := store.updateSeen[1]
+	if resubmitted["fieldA"] != "user-a" {
+		t.Errorf("fieldA = %v, want user-a unchanged (nothing should have been merged)", resubmitted["fieldA"])
+	}
+}
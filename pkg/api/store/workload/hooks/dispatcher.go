@@ -0,0 +1,204 @@
+// Package hooks implements Argo-style sync-wave ordering and lifecycle
+// hooks (PreSync/Sync/PostSync/SyncFail) for workload creation, as driven
+// by CustomizeStore.Create in the parent workload store package.
+package hooks
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Dispatcher serializes workload creation within each namespace by sync
+// wave: a workload queued into wave N only proceeds once every workload
+// queued into a wave below N has reported whether it became Ready.
+type Dispatcher struct {
+	mu         sync.Mutex
+	namespaces map[string]*namespaceQueue
+}
+
+// NewDispatcher returns an empty Dispatcher. A Dispatcher is safe for
+// concurrent use and is typically shared across every Create call made
+// against the workload store.
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{namespaces: map[string]*namespaceQueue{}}
+}
+
+func (d *Dispatcher) queueFor(namespace string) *namespaceQueue {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	nq, ok := d.namespaces[namespace]
+	if !ok {
+		nq = newNamespaceQueue()
+		d.namespaces[namespace] = nq
+	}
+	return nq
+}
+
+// AwaitTurn blocks until every sync wave below `wave` in `namespace` has
+// completed, or until timeout elapses, then admits the caller into
+// `wave`. The returned complete func must be called exactly once, with
+// whether the workload was ultimately observed Ready, so that later
+// waves (and any registered SyncFail hooks) can proceed.
+func (d *Dispatcher) AwaitTurn(namespace string, wave int, timeout time.Duration) (complete func(ready bool), err error) {
+	nq := d.queueFor(namespace)
+	if err := nq.waitBelow(wave, timeout); err != nil {
+		return nil, err
+	}
+	return nq.join(wave), nil
+}
+
+// AwaitAll blocks until every sync wave currently known in `namespace`
+// has completed. It is used to gate PostSync hook Jobs, which run only
+// after every Sync-wave workload submitted ahead of them is Ready.
+func (d *Dispatcher) AwaitAll(namespace string, timeout time.Duration) error {
+	return d.queueFor(namespace).waitAll(timeout)
+}
+
+// OnWaveFailed registers fn to run, in its own goroutine, the first time
+// any member of `wave` in `namespace` completes with ready=false. It is
+// the trigger used to run a SyncFail hook Job.
+func (d *Dispatcher) OnWaveFailed(namespace string, wave int, fn func()) {
+	d.queueFor(namespace).onFailed(wave, fn)
+}
+
+type namespaceQueue struct {
+	mu    sync.Mutex
+	waves map[int]*wave
+}
+
+type wave struct {
+	pending   int
+	failed    bool
+	done      chan struct{}
+	failHooks []func()
+}
+
+func newNamespaceQueue() *namespaceQueue {
+	return &namespaceQueue{waves: map[int]*wave{}}
+}
+
+func (nq *namespaceQueue) waveFor(n int) *wave {
+	nq.mu.Lock()
+	defer nq.mu.Unlock()
+	w, ok := nq.waves[n]
+	if !ok {
+		w = &wave{done: make(chan struct{})}
+		nq.waves[n] = w
+	}
+	return w
+}
+
+func (nq *namespaceQueue) waitBelow(wave int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	nq.mu.Lock()
+	lowest := 0
+	for n := range nq.waves {
+		if n < lowest {
+			lowest = n
+		}
+	}
+	nq.mu.Unlock()
+
+	for n := lowest; n < wave; n++ {
+		if err := nq.waitFor(n, deadline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (nq *namespaceQueue) waitAll(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	nq.mu.Lock()
+	highest := -1
+	lowest := 0
+	for n := range nq.waves {
+		if n > highest {
+			highest = n
+		}
+		if n < lowest {
+			lowest = n
+		}
+	}
+	nq.mu.Unlock()
+
+	for n := lowest; n <= highest; n++ {
+		if err := nq.waitFor(n, deadline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (nq *namespaceQueue) waitFor(n int, deadline time.Time) error {
+	nq.mu.Lock()
+	w, ok := nq.waves[n]
+	nq.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return fmt.Errorf("timed out waiting for sync-wave %d", n)
+	}
+	select {
+	case <-w.done:
+		return nil
+	case <-time.After(remaining):
+		return fmt.Errorf("timed out waiting for sync-wave %d", n)
+	}
+}
+
+func (nq *namespaceQueue) join(n int) func(ready bool) {
+	nq.mu.Lock()
+	w := nq.waves[n]
+	if w == nil {
+		w = &wave{done: make(chan struct{})}
+		nq.waves[n] = w
+	}
+	w.pending++
+	nq.mu.Unlock()
+
+	return func(ready bool) {
+		nq.mu.Lock()
+		w.pending--
+		shouldFireHooks := !ready && !w.failed
+		if !ready {
+			w.failed = true
+		}
+		waveDone := w.pending <= 0
+		fireHooks := append([]func(){}, w.failHooks...)
+		if waveDone {
+			// Remove the now-fully-drained wave so a later join for the
+			// same wave number starts a fresh instance, with its own
+			// open done channel, instead of reusing this one: reusing it
+			// would mean the channel is already closed, so a subsequent
+			// waitBelow for a higher wave would see it as done before
+			// this new member has actually completed.
+			if nq.waves[n] == w {
+				delete(nq.waves, n)
+			}
+		}
+		nq.mu.Unlock()
+
+		if waveDone {
+			close(w.done)
+		}
+		if shouldFireHooks {
+			for _, fn := range fireHooks {
+				go fn()
+			}
+		}
+	}
+}
+
+func (nq *namespaceQueue) onFailed(n int, fn func()) {
+	w := nq.waveFor(n)
+	nq.mu.Lock()
+	w.failHooks = append(w.failHooks, fn)
+	nq.mu.Unlock()
+}
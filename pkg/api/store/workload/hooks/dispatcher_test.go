@@ -0,0 +1,168 @@
+package hooks
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAwaitTurnBlocksUntilEarlierWaveCompletes(t *testing.T) {
+	d := NewDispatcher()
+
+	completeWave0, err := d.AwaitTurn("ns", 0, time.Second)
+	if err != nil {
+		t.Fatalf("AwaitTurn(wave 0): %v", err)
+	}
+
+	wave1Admitted := make(chan struct{})
+	go func() {
+		if _, err := d.AwaitTurn("ns", 1, time.Second); err != nil {
+			t.Errorf("AwaitTurn(wave 1): %v", err)
+		}
+		close(wave1Admitted)
+	}()
+
+	select {
+	case <-wave1Admitted:
+		t.Fatal("wave 1 was admitted before wave 0 completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	completeWave0(true)
+
+	select {
+	case <-wave1Admitted:
+	case <-time.After(time.Second):
+		t.Fatal("wave 1 was never admitted after wave 0 completed")
+	}
+}
+
+func TestAwaitTurnTimesOutIfEarlierWaveNeverCompletes(t *testing.T) {
+	d := NewDispatcher()
+
+	if _, err := d.AwaitTurn("ns", 0, time.Hour); err != nil {
+		t.Fatalf("AwaitTurn(wave 0): %v", err)
+	}
+	// wave 0's complete func is deliberately never called.
+
+	if _, err := d.AwaitTurn("ns", 1, 50*time.Millisecond); err == nil {
+		t.Fatal("expected AwaitTurn(wave 1) to time out, got nil error")
+	}
+}
+
+func TestOnWaveFailedFiresWhenAMemberReportsNotReady(t *testing.T) {
+	d := NewDispatcher()
+
+	var fired sync.WaitGroup
+	fired.Add(1)
+	d.OnWaveFailed("ns", 0, func() { fired.Done() })
+
+	complete, err := d.AwaitTurn("ns", 0, time.Second)
+	if err != nil {
+		t.Fatalf("AwaitTurn: %v", err)
+	}
+	complete(false)
+
+	done := make(chan struct{})
+	go func() { fired.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("OnWaveFailed hook never fired after a wave member reported not-ready")
+	}
+}
+
+func TestOnWaveFailedDoesNotFireOnSuccess(t *testing.T) {
+	d := NewDispatcher()
+
+	fired := false
+	d.OnWaveFailed("ns", 0, func() { fired = true })
+
+	complete, err := d.AwaitTurn("ns", 0, time.Second)
+	if err != nil {
+		t.Fatalf("AwaitTurn: %v", err)
+	}
+	complete(true)
+
+	time.Sleep(50 * time.Millisecond)
+	if fired {
+		t.Error("OnWaveFailed hook fired despite the wave succeeding")
+	}
+}
+
+// TestWaveIsReusableAfterDraining guards against a wave's done channel
+// being reused once closed: a second member joining wave 0 after the
+// first has already drained must still block a later wave until it too
+// completes.
+func TestWaveIsReusableAfterDraining(t *testing.T) {
+	d := NewDispatcher()
+
+	complete1, err := d.AwaitTurn("ns", 0, time.Second)
+	if err != nil {
+		t.Fatalf("AwaitTurn(first wave-0 member): %v", err)
+	}
+	complete1(true)
+
+	complete2, err := d.AwaitTurn("ns", 0, time.Second)
+	if err != nil {
+		t.Fatalf("AwaitTurn(second wave-0 member): %v", err)
+	}
+
+	wave1Admitted := make(chan struct{})
+	go func() {
+		if _, err := d.AwaitTurn("ns", 1, time.Second); err != nil {
+			t.Errorf("AwaitTurn(wave 1): %v", err)
+		}
+		close(wave1Admitted)
+	}()
+
+	select {
+	case <-wave1Admitted:
+		t.Fatal("wave 1 was admitted before the second wave-0 member completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	complete2(true)
+
+	select {
+	case <-wave1Admitted:
+	case <-time.After(time.Second):
+		t.Fatal("wave 1 was never admitted after the second wave-0 member completed")
+	}
+}
+
+func TestAwaitAllWaitsForEveryWaveSeenSoFar(t *testing.T) {
+	d := NewDispatcher()
+
+	complete0, err := d.AwaitTurn("ns", 0, time.Second)
+	if err != nil {
+		t.Fatalf("AwaitTurn(wave 0): %v", err)
+	}
+	complete1, err := d.AwaitTurn("ns", 1, time.Second)
+	if err != nil {
+		t.Fatalf("AwaitTurn(wave 1): %v", err)
+	}
+
+	awaitAllDone := make(chan struct{})
+	go func() {
+		if err := d.AwaitAll("ns", time.Second); err != nil {
+			t.Errorf("AwaitAll: %v", err)
+		}
+		close(awaitAllDone)
+	}()
+
+	select {
+	case <-awaitAllDone:
+		t.Fatal("AwaitAll returned before every known wave completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	complete0(true)
+	complete1(true)
+
+	select {
+	case <-awaitAllDone:
+	case <-time.After(time.Second):
+		t.Fatal("AwaitAll never returned after every known wave completed")
+	}
+}
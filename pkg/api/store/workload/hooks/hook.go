@@ -0,0 +1,97 @@
+package hooks
+
+import (
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Hook is the lifecycle point a Job-kind workload runs at, as set via the
+// workload.cattle.io/hook annotation.
+type Hook string
+
+const (
+	PreSync  Hook = "PreSync"
+	Sync     Hook = "Sync"
+	PostSync Hook = "PostSync"
+	SyncFail Hook = "SyncFail"
+)
+
+// DeletePolicy controls when a hook Job is cleaned up, as set via the
+// workload.cattle.io/hook-delete-policy annotation.
+type DeletePolicy string
+
+const (
+	HookSucceeded      DeletePolicy = "HookSucceeded"
+	BeforeHookCreation DeletePolicy = "BeforeHookCreation"
+	HookFailed         DeletePolicy = "HookFailed"
+)
+
+const defaultPollInterval = 2 * time.Second
+
+// JobClient is the subset of a namespaced batch/v1 Job client the hook
+// Runner needs. Implementations talk to the target cluster's client.
+type JobClient interface {
+	// Create submits the hook Job described by spec and returns its name.
+	Create(namespace string, spec map[string]interface{}) (name string, err error)
+	// Status reports whether the named Job has completed, successfully
+	// or not. Both return values are false while the Job is still running.
+	Status(namespace, name string) (succeeded, failed bool, err error)
+	Delete(namespace, name string) error
+}
+
+// Runner creates an ephemeral hook Job, waits for it to finish, and
+// enforces the requested DeletePolicy.
+type Runner struct {
+	Jobs    JobClient
+	Timeout time.Duration
+}
+
+// Run creates the hook Job described by spec under the given name and
+// blocks until it succeeds or fails (or Timeout elapses), applying
+// policy. It returns an error if the Job failed, timed out, or could not
+// be created.
+func (r *Runner) Run(namespace, name string, spec map[string]interface{}, policy DeletePolicy) error {
+	if policy == BeforeHookCreation {
+		// "delete if present, then create" must be a no-op the first time
+		// a hook Job runs in a clean namespace - there is no previous Job
+		// to delete yet.
+		if err := r.Jobs.Delete(namespace, name); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("deleting previous hook job %s/%s: %v", namespace, name, err)
+		}
+	}
+
+	created, err := r.Jobs.Create(namespace, spec)
+	if err != nil {
+		return fmt.Errorf("creating hook job %s/%s: %v", namespace, name, err)
+	}
+
+	deadline := time.Now().Add(r.Timeout)
+	for {
+		succeeded, failed, err := r.Jobs.Status(namespace, created)
+		if err != nil {
+			return fmt.Errorf("checking hook job %s/%s status: %v", namespace, created, err)
+		}
+
+		switch {
+		case succeeded:
+			if policy == HookSucceeded {
+				return r.Jobs.Delete(namespace, created)
+			}
+			return nil
+		case failed:
+			if policy == HookFailed {
+				if err := r.Jobs.Delete(namespace, created); err != nil {
+					return fmt.Errorf("hook job %s/%s failed and could not be deleted: %v", namespace, created, err)
+				}
+			}
+			return fmt.Errorf("hook job %s/%s failed", namespace, created)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for hook job %s/%s", namespace, created)
+		}
+		time.Sleep(defaultPollInterval)
+	}
+}
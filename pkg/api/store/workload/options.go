@@ -0,0 +1,137 @@
+package workload
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/rancher/pkg/api/customization/workload"
+	"github.com/rancher/types/apis/project.cattle.io/v3/schema"
+
+	"github.com/rancher/norman/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PortNamer computes the name given to a container port the user left
+// unnamed, replacing the historical fixed containerPortProtoSourcePortKind
+// scheme hardcoded into setPorts.
+type PortNamer func(containerPort int64, protocol, sourcePort, kind string) string
+
+// CredentialResolver resolves the imagePullSecrets configured for a
+// namespace, keyed by registry domain. The default, getCreds, reads
+// dockerCredential and namespacedDockerCredential resources.
+type CredentialResolver func(apiContext *types.APIContext, namespaceID string) map[string][]corev1.LocalObjectReference
+
+// RegistryAuthResolver resolves the username/password configured on the
+// named docker credential for domain, so resolveImages can authenticate
+// its digest lookups against registries that require it. The default,
+// getRegistryAuth, reads the same dockerCredential and
+// namespacedDockerCredential resources as CredentialResolver.
+type RegistryAuthResolver func(apiContext *types.APIContext, credentialName, domain string) (username, password string)
+
+type config struct {
+	schemas            []*types.Schema
+	formatters         map[string]types.Formatter
+	portNamer          PortNamer
+	credentialResolver CredentialResolver
+	registryAuth       RegistryAuthResolver
+	resolver           registryResolver
+	actionHandler      func(actionName string, action *types.Action, apiContext *types.APIContext) error
+}
+
+// Option configures New and NewCustomizeStore.
+type Option func(*config)
+
+// WithSchema adds an additional sub-schema - for example a future
+// virtualMachineInstance kind - to the aggregate workload store.
+func WithSchema(s *types.Schema) Option {
+	return func(c *config) { c.schemas = append(c.schemas, s) }
+}
+
+// WithFormatter sets the Formatter used for the sub-schema with the given
+// ID. Sub-schemas without a formatter default to workload.Formatter.
+func WithFormatter(id string, fn types.Formatter) Option {
+	return func(c *config) { c.formatters[id] = fn }
+}
+
+// WithPortNamer overrides the naming scheme setPorts uses for container
+// ports the user left unnamed.
+func WithPortNamer(namer PortNamer) Option {
+	return func(c *config) { c.portNamer = namer }
+}
+
+// WithCredentialResolver overrides how setSecrets and resolveImages look
+// up the docker credentials configured for a namespace.
+func WithCredentialResolver(resolver CredentialResolver) Option {
+	return func(c *config) { c.credentialResolver = resolver }
+}
+
+// WithRegistryAuthResolver overrides how resolveImages looks up the
+// username/password backing a docker credential when authenticating a
+// digest lookup against a registry.
+func WithRegistryAuthResolver(resolver RegistryAuthResolver) Option {
+	return func(c *config) { c.registryAuth = resolver }
+}
+
+// WithActionHandler sets the handler the workload schema falls back to
+// once the built-in promote/abort rollout actions have been ruled out.
+func WithActionHandler(fn func(actionName string, action *types.Action, apiContext *types.APIContext) error) Option {
+	return func(c *config) { c.actionHandler = fn }
+}
+
+// WithDefaults applies Rancher's built-in behavior: the seven built-in
+// workload kinds, the DeploymentFormatter/Formatter split, and (via the
+// zero-value fallbacks in New/NewCustomizeStore) the historical port
+// naming scheme and docker-credential-based secret resolution.
+func WithDefaults(schemas *types.Schemas) Option {
+	return func(c *config) {
+		c.schemas = append(c.schemas,
+			schemas.Schema(&schema.Version, "deployment"),
+			schemas.Schema(&schema.Version, "replicaSet"),
+			schemas.Schema(&schema.Version, "replicationController"),
+			schemas.Schema(&schema.Version, "daemonSet"),
+			schemas.Schema(&schema.Version, "statefulSet"),
+			schemas.Schema(&schema.Version, "job"),
+			schemas.Schema(&schema.Version, "cronJob"),
+		)
+		c.formatters["deployment"] = workload.DeploymentFormatter
+	}
+}
+
+// defaultPortNamer reproduces the historical containerPortProtoSourcePortKind
+// scheme: no separator, with kind numerated, to stay within Kubernetes'
+// 15-character port name limit.
+func defaultPortNamer(containerPort int64, protocol, sourcePort, kind string) string {
+	numKind := 0
+	switch kind {
+	case "NodePort":
+		numKind = 1
+	case "ClusterIP":
+		numKind = 2
+	case "LoadBalancer":
+		numKind = 3
+	}
+
+	return fmt.Sprintf("%s%s%s%s", strconv.Itoa(int(containerPort)),
+		strings.ToLower(protocol), strings.ToLower(sourcePort), strconv.Itoa(numKind))
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{formatters: map[string]types.Formatter{}}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.portNamer == nil {
+		c.portNamer = defaultPortNamer
+	}
+	if c.credentialResolver == nil {
+		c.credentialResolver = getCreds
+	}
+	if c.registryAuth == nil {
+		c.registryAuth = getRegistryAuth
+	}
+	if c.resolver == nil {
+		c.resolver = newDefaultRegistryResolver()
+	}
+	return c
+}
@@ -0,0 +1,90 @@
+package workload
+
+import (
+	"testing"
+
+	"github.com/rancher/norman/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// TestNewConfigAppliesCustomOptions demonstrates a subsystem plugging a
+// custom PortNamer, CredentialResolver and action handler into the
+// aggregate store via Option, without forking this package to do it.
+func TestNewConfigAppliesCustomOptions(t *testing.T) {
+	customPortNamer := func(containerPort int64, protocol, sourcePort, kind string) string {
+		return "custom-port"
+	}
+	customCredentialResolver := func(*types.APIContext, string) map[string][]corev1.LocalObjectReference {
+		return map[string][]corev1.LocalObjectReference{"example.com": nil}
+	}
+	var actionHandlerCalled bool
+	customActionHandler := func(actionName string, action *types.Action, apiContext *types.APIContext) error {
+		actionHandlerCalled = true
+		return nil
+	}
+
+	c := newConfig([]Option{
+		WithPortNamer(customPortNamer),
+		WithCredentialResolver(customCredentialResolver),
+		WithActionHandler(customActionHandler),
+	})
+
+	if got := c.portNamer(8080, "TCP", "", "ClusterIP"); got != "custom-port" {
+		t.Errorf("portNamer = %q, want custom-port", got)
+	}
+	if _, ok := c.credentialResolver(nil, "ns")["example.com"]; !ok {
+		t.Error("credentialResolver was not the custom one supplied via WithCredentialResolver")
+	}
+	if err := c.actionHandler("promote", nil, nil); err != nil || !actionHandlerCalled {
+		t.Errorf("actionHandler was not the custom one supplied via WithActionHandler (called=%v, err=%v)", actionHandlerCalled, err)
+	}
+}
+
+// TestNewConfigFillsInDefaults ensures options a caller doesn't supply
+// still resolve to Rancher's built-in behavior rather than being left
+// nil.
+func TestNewConfigFillsInDefaults(t *testing.T) {
+	c := newConfig(nil)
+
+	if c.portNamer == nil {
+		t.Error("portNamer default was not applied")
+	}
+	if c.credentialResolver == nil {
+		t.Error("credentialResolver default was not applied")
+	}
+	if c.registryAuth == nil {
+		t.Error("registryAuth default was not applied")
+	}
+	if c.resolver == nil {
+		t.Error("resolver default was not applied")
+	}
+}
+
+// TestWithSchemaAppendsWithoutReplacing ensures a custom subsystem's
+// sub-schema (e.g. a future virtualMachineInstance kind) is added
+// alongside, not instead of, any already configured.
+func TestWithSchemaAppendsWithoutReplacing(t *testing.T) {
+	first := &types.Schema{ID: "deployment"}
+	second := &types.Schema{ID: "virtualMachineInstance"}
+
+	c := newConfig([]Option{WithSchema(first), WithSchema(second)})
+
+	if len(c.schemas) != 2 || c.schemas[0] != first || c.schemas[1] != second {
+		t.Errorf("schemas = %v, want [%v %v]", c.schemas, first, second)
+	}
+}
+
+// TestWithFormatterOnlySetsTheNamedSchema ensures a formatter registered
+// for one sub-schema ID doesn't leak onto another.
+func TestWithFormatterOnlySetsTheNamedSchema(t *testing.T) {
+	var customFormatter types.Formatter
+
+	c := newConfig([]Option{WithFormatter("deployment", customFormatter)})
+
+	if _, ok := c.formatters["deployment"]; !ok {
+		t.Error("expected a formatter registered for \"deployment\"")
+	}
+	if _, ok := c.formatters["replicaSet"]; ok {
+		t.Error("formatter for \"deployment\" leaked onto \"replicaSet\"")
+	}
+}
@@ -0,0 +1,218 @@
+package workload
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResolvedDigestsAnnotation records the tag->digest mapping applied by a
+// registryResolver so users can see what image references got pinned.
+const ResolvedDigestsAnnotation = "workload.cattle.io/resolved-digests"
+
+// Values accepted by the workload schema's imageResolutionPolicy field.
+const (
+	ImageResolutionAlways      = "Always"
+	ImageResolutionIfNotPinned = "IfNotPinned"
+	ImageResolutionNever       = "Never"
+)
+
+const digestCacheTTL = 5 * time.Minute
+
+// registryResolver resolves an image:tag reference to an immutable digest,
+// authenticating with username/password when the registry requires it.
+// Either may be empty, in which case ResolveDigest falls back to an
+// anonymous request (and, for registries like Docker Hub that require a
+// bearer token even for public images, an anonymous token exchange).
+type registryResolver interface {
+	ResolveDigest(domain, repository, tag, username, password string) (digest string, err error)
+}
+
+type digestCacheKey struct {
+	domain     string
+	repository string
+	tag        string
+	username   string
+}
+
+type digestCacheEntry struct {
+	digest    string
+	expiresAt time.Time
+}
+
+// cachingRegistryResolver memoizes digest lookups for digestCacheTTL, keyed
+// by (domain, repository, tag, username), so that creating or updating many
+// workloads against the same tag doesn't hammer the registry. The
+// credential name and password are not part of the key: two credentials
+// with the same username for the same domain share cache entries.
+type cachingRegistryResolver struct {
+	next registryResolver
+
+	mu    sync.Mutex
+	cache map[digestCacheKey]digestCacheEntry
+}
+
+func newCachingRegistryResolver(next registryResolver) *cachingRegistryResolver {
+	return &cachingRegistryResolver{
+		next:  next,
+		cache: map[digestCacheKey]digestCacheEntry{},
+	}
+}
+
+func (c *cachingRegistryResolver) ResolveDigest(domain, repository, tag, username, password string) (string, error) {
+	key := digestCacheKey{domain: domain, repository: repository, tag: tag, username: username}
+
+	c.mu.Lock()
+	entry, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.digest, nil
+	}
+
+	digest, err := c.next.ResolveDigest(domain, repository, tag, username, password)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.cache[key] = digestCacheEntry{digest: digest, expiresAt: time.Now().Add(digestCacheTTL)}
+	c.mu.Unlock()
+
+	return digest, nil
+}
+
+// v2RegistryResolver resolves digests against a v2 Docker Registry API
+// endpoint by issuing a HEAD request for the manifest and reading back the
+// Docker-Content-Digest header.
+type v2RegistryResolver struct {
+	client *http.Client
+}
+
+func newDefaultRegistryResolver() registryResolver {
+	return newCachingRegistryResolver(&v2RegistryResolver{
+		client: &http.Client{Timeout: 10 * time.Second},
+	})
+}
+
+func (r *v2RegistryResolver) ResolveDigest(domain, repository, tag, username, password string) (string, error) {
+	url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", domain, repository, tag)
+
+	resp, err := r.headManifest(url, username, password, "")
+	if err != nil {
+		return "", fmt.Errorf("resolving digest for %s/%s:%s: %v", domain, repository, tag, err)
+	}
+	defer resp.Body.Close()
+
+	// Most registries, including Docker Hub, answer an unauthenticated
+	// HEAD with 401 and a Www-Authenticate challenge even for public
+	// images - they require a (possibly anonymous) bearer token.
+	if resp.StatusCode == http.StatusUnauthorized {
+		token, err := r.authenticate(resp.Header.Get("Www-Authenticate"), username, password)
+		if err != nil {
+			return "", fmt.Errorf("resolving digest for %s/%s:%s: authenticating: %v", domain, repository, tag, err)
+		}
+		resp.Body.Close()
+
+		resp, err = r.headManifest(url, "", "", token)
+		if err != nil {
+			return "", fmt.Errorf("resolving digest for %s/%s:%s: %v", domain, repository, tag, err)
+		}
+		defer resp.Body.Close()
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("resolving digest for %s/%s:%s: registry returned %s", domain, repository, tag, resp.Status)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("resolving digest for %s/%s:%s: registry did not return Docker-Content-Digest", domain, repository, tag)
+	}
+
+	return digest, nil
+}
+
+// headManifest issues the manifest HEAD request, authenticating with
+// bearerToken if set, falling back to HTTP Basic auth from
+// username/password otherwise.
+func (r *v2RegistryResolver) headManifest(url, username, password, bearerToken string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.list.v2+json, "+
+		"application/vnd.docker.distribution.manifest.v2+json")
+
+	switch {
+	case bearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+bearerToken)
+	case username != "" || password != "":
+		req.SetBasicAuth(username, password)
+	}
+
+	return r.client.Do(req)
+}
+
+var bearerChallengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authenticate performs the Docker v2 bearer-token exchange described by a
+// 401 response's Www-Authenticate header: it fetches a token from the
+// challenge's realm (passing username/password as Basic auth when set, or
+// requesting an anonymous token otherwise) and returns it for use as a
+// Bearer Authorization header on the retried manifest request.
+func (r *v2RegistryResolver) authenticate(challenge, username, password string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("unsupported Www-Authenticate challenge %q", challenge)
+	}
+
+	params := map[string]string{}
+	for _, m := range bearerChallengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("challenge %q is missing realm", challenge)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, realm, nil)
+	if err != nil {
+		return "", err
+	}
+	q := req.URL.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	if scope := params["scope"]; scope != "" {
+		q.Set("scope", scope)
+	}
+	req.URL.RawQuery = q.Encode()
+	if username != "" || password != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint %s returned %s", realm, resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decoding token response from %s: %v", realm, err)
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
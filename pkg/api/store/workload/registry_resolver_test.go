@@ -0,0 +1,155 @@
+package workload
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/rancher/norman/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fakeRegistryResolver is the test double registryResolver exists to
+// support: it records every call it receives and returns a fixed
+// digest (or error) without making a network call.
+type fakeRegistryResolver struct {
+	calls  int
+	digest string
+	err    error
+}
+
+func (f *fakeRegistryResolver) ResolveDigest(domain, repository, tag, username, password string) (string, error) {
+	f.calls++
+	if f.err != nil {
+		return "", f.err
+	}
+	return f.digest, nil
+}
+
+func newTestStore(resolver registryResolver) *CustomizeStore {
+	return &CustomizeStore{
+		resolver: resolver,
+		credentialResolver: func(*types.APIContext, string) map[string][]corev1.LocalObjectReference {
+			return nil
+		},
+		registryAuth: func(*types.APIContext, string, string) (string, string) {
+			return "", ""
+		},
+	}
+}
+
+func TestResolveImagesPinsUnpinnedImage(t *testing.T) {
+	resolver := &fakeRegistryResolver{digest: "sha256:deadbeef"}
+	s := newTestStore(resolver)
+
+	data := map[string]interface{}{
+		"imageResolutionPolicy": ImageResolutionAlways,
+		"containers": []map[string]interface{}{
+			{"image": "nginx:1.19"},
+		},
+	}
+
+	if err := s.resolveImages(&types.APIContext{}, data); err != nil {
+		t.Fatalf("resolveImages: %v", err)
+	}
+	if resolver.calls != 1 {
+		t.Errorf("resolver called %d times, want 1", resolver.calls)
+	}
+
+	containers := data["containers"].([]map[string]interface{})
+	want := "docker.io/library/nginx@sha256:deadbeef"
+	if got := containers[0]["image"]; got != want {
+		t.Errorf("container image = %v, want %v", got, want)
+	}
+
+	annotations, _ := data["annotations"].(map[string]interface{})
+	raw, ok := annotations[ResolvedDigestsAnnotation]
+	if !ok {
+		t.Fatalf("expected %s annotation to be set", ResolvedDigestsAnnotation)
+	}
+	var resolved map[string]string
+	if err := json.Unmarshal([]byte(raw.(string)), &resolved); err != nil {
+		t.Fatalf("unmarshal %s: %v", ResolvedDigestsAnnotation, err)
+	}
+	if resolved["nginx:1.19"] != "sha256:deadbeef" {
+		t.Errorf("%s = %v, want nginx:1.19 -> sha256:deadbeef", ResolvedDigestsAnnotation, resolved)
+	}
+}
+
+func TestResolveImagesSkipsAlreadyDigestedUnderIfNotPinned(t *testing.T) {
+	resolver := &fakeRegistryResolver{digest: "sha256:deadbeef"}
+	s := newTestStore(resolver)
+
+	data := map[string]interface{}{
+		"imageResolutionPolicy": ImageResolutionIfNotPinned,
+		"containers": []map[string]interface{}{
+			{"image": "nginx@sha256:cafef00d"},
+		},
+	}
+
+	if err := s.resolveImages(&types.APIContext{}, data); err != nil {
+		t.Fatalf("resolveImages: %v", err)
+	}
+	if resolver.calls != 0 {
+		t.Errorf("resolver called %d times for an already-pinned image, want 0", resolver.calls)
+	}
+}
+
+func TestResolveImagesNeverSkipsResolution(t *testing.T) {
+	resolver := &fakeRegistryResolver{digest: "sha256:deadbeef"}
+	s := newTestStore(resolver)
+
+	data := map[string]interface{}{
+		"imageResolutionPolicy": ImageResolutionNever,
+		"containers": []map[string]interface{}{
+			{"image": "nginx:1.19"},
+		},
+	}
+
+	if err := s.resolveImages(&types.APIContext{}, data); err != nil {
+		t.Fatalf("resolveImages: %v", err)
+	}
+	if resolver.calls != 0 {
+		t.Errorf("resolver called %d times under ImageResolutionNever, want 0", resolver.calls)
+	}
+}
+
+func TestResolveImagesLeavesImageUnpinnedOnResolverError(t *testing.T) {
+	resolver := &fakeRegistryResolver{err: errors.New("registry unreachable")}
+	s := newTestStore(resolver)
+
+	data := map[string]interface{}{
+		"imageResolutionPolicy": ImageResolutionAlways,
+		"containers": []map[string]interface{}{
+			{"image": "nginx:1.19"},
+		},
+	}
+
+	if err := s.resolveImages(&types.APIContext{}, data); err != nil {
+		t.Fatalf("resolveImages: %v", err)
+	}
+
+	containers := data["containers"].([]map[string]interface{})
+	if got := containers[0]["image"]; got != "nginx:1.19" {
+		t.Errorf("image changed to %v despite resolver error", got)
+	}
+}
+
+func TestCachingRegistryResolverReusesResultWithinTTL(t *testing.T) {
+	resolver := &fakeRegistryResolver{digest: "sha256:deadbeef"}
+	caching := newCachingRegistryResolver(resolver)
+
+	for i := 0; i < 3; i++ {
+		digest, err := caching.ResolveDigest("index.docker.io", "library/nginx", "1.19", "", "")
+		if err != nil {
+			t.Fatalf("ResolveDigest: %v", err)
+		}
+		if digest != "sha256:deadbeef" {
+			t.Errorf("digest = %q, want sha256:deadbeef", digest)
+		}
+	}
+
+	if resolver.calls != 1 {
+		t.Errorf("underlying resolver called %d times, want 1 (result should be cached)", resolver.calls)
+	}
+}
@@ -0,0 +1,577 @@
+package workload
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rancher/norman/httperror"
+	"github.com/rancher/norman/types"
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/norman/types/values"
+	"github.com/rancher/rancher/pkg/clustermanager"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Deployment strategies beyond the built-in Recreate/RollingUpdate.
+const (
+	StrategyBlueGreen = "BlueGreen"
+	StrategyCanary    = "Canary"
+
+	defaultScaleDownDelaySeconds = 30
+	rolloutPollInterval          = 2 * time.Second
+	rolloutReadyTimeout          = 5 * time.Minute
+
+	// state keys persisted under the workload.cattle.io/state annotation,
+	// alongside the scheduling state written by setScheduling.
+	stateKeyCanaryStep = "rollout.canaryStep"
+
+	// stableReplicasAnnotation records, on the Deployment itself, the
+	// replica count in effect before canary weighting began, so every
+	// setCanaryWeight call scales a consistent total and abort can
+	// restore it exactly.
+	stableReplicasAnnotation = "workload.cattle.io/canary-stable-replicas"
+)
+
+var (
+	deploymentsGVR            = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	replicaSetsGVR            = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}
+	replicationControllersGVR = schema.GroupVersionResource{Version: "v1", Resource: "replicationcontrollers"}
+	daemonSetsGVR             = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "daemonsets"}
+	statefulSetsGVR           = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "statefulsets"}
+	servicesGVR               = schema.GroupVersionResource{Version: "v1", Resource: "services"}
+
+	// workloadGVRs maps each workload schema kind WithDefaults registers
+	// to the GVR waitWorkloadReady polls for readiness. Job/CronJob are
+	// intentionally absent - awaitReady excludes them from the
+	// sync-wave readiness gate entirely, since their completion is
+	// tracked by runHookJob instead.
+	workloadGVRs = map[string]schema.GroupVersionResource{
+		"deployment":            deploymentsGVR,
+		"replicaset":            replicaSetsGVR,
+		"replicationcontroller": replicationControllersGVR,
+		"daemonset":             daemonSetsGVR,
+		"statefulset":           statefulSetsGVR,
+	}
+)
+
+// canaryStep is one entry of deploymentConfig.strategyConfig.canary.steps.
+type canaryStep struct {
+	SetWeight int `json:"setWeight"`
+	Pause     *struct {
+		Duration string `json:"duration"`
+	} `json:"pause"`
+}
+
+// applyStrategy mutates data (and, for BlueGreen/Canary on an existing
+// workload, drives the rollout against the cluster) according to
+// deploymentConfig.strategy. id is empty on Create, since there is no
+// previous revision to roll out from.
+func applyStrategy(apiContext *types.APIContext, manager *clustermanager.Manager, id string, data map[string]interface{}) error {
+	strategy, ok := values.GetValue(data, "deploymentConfig", "strategy")
+	if !ok {
+		return nil
+	}
+
+	switch convert.ToString(strategy) {
+	case "Recreate":
+		values.RemoveValue(data, "deploymentConfig", "maxSurge")
+		values.RemoveValue(data, "deploymentConfig", "maxUnavailable")
+	case StrategyBlueGreen:
+		if id == "" {
+			return nil
+		}
+		return runBlueGreenRollout(apiContext, manager, id, data)
+	case StrategyCanary:
+		if id == "" {
+			return nil
+		}
+		return runCanaryRollout(apiContext, manager, id, data)
+	}
+
+	return nil
+}
+
+func rolloutClient(apiContext *types.APIContext, manager *clustermanager.Manager) (dynamicClient, error) {
+	clusterName := clustermanager.ClusterName(apiContext)
+	client, err := manager.Dynamic(clusterName)
+	if err != nil {
+		return nil, fmt.Errorf("getting dynamic client for cluster %s: %v", clusterName, err)
+	}
+	return client, nil
+}
+
+// dynamicClient is the subset of a cluster's dynamic client the rollout
+// orchestration needs; it is an interface so it can be faked in tests.
+type dynamicClient interface {
+	Get(gvr schema.GroupVersionResource, namespace, name string) (*unstructured.Unstructured, error)
+	List(gvr schema.GroupVersionResource, namespace string, labelSelector map[string]string) ([]*unstructured.Unstructured, error)
+	Create(gvr schema.GroupVersionResource, namespace string, obj *unstructured.Unstructured) (*unstructured.Unstructured, error)
+	Update(gvr schema.GroupVersionResource, namespace string, obj *unstructured.Unstructured) (*unstructured.Unstructured, error)
+	Delete(gvr schema.GroupVersionResource, namespace, name string) error
+}
+
+func runBlueGreenRollout(apiContext *types.APIContext, manager *clustermanager.Manager, id string, data map[string]interface{}) error {
+	namespace, name := splitNamespaceAndName(id)
+
+	client, err := rolloutClient(apiContext, manager)
+	if err != nil {
+		return err
+	}
+
+	greenName := name + "-green"
+	green, err := buildGreenDeployment(client, namespace, name, greenName, data)
+	if err != nil {
+		return err
+	}
+
+	if err := waitWorkloadReady(client, deploymentsGVR, namespace, greenName, rolloutReadyTimeout); err != nil {
+		return fmt.Errorf("waiting for %s to become ready: %v", greenName, err)
+	}
+
+	if err := flipServiceSelector(client, namespace, name, green); err != nil {
+		return err
+	}
+
+	scaleDownDelay := defaultScaleDownDelaySeconds
+	if v, ok := values.GetValue(data, "deploymentConfig", "strategyConfig", "blueGreen", "scaleDownDelaySeconds"); ok {
+		if n, err := convert.ToNumber(v); err == nil {
+			scaleDownDelay = int(n)
+		}
+	}
+
+	go deleteOldReplicaSetAfterDelay(client, namespace, name, time.Duration(scaleDownDelay)*time.Second)
+
+	return nil
+}
+
+func buildGreenDeployment(client dynamicClient, namespace, blueName, greenName string, data map[string]interface{}) (*unstructured.Unstructured, error) {
+	blue, err := client.Get(deploymentsGVR, namespace, blueName)
+	if err != nil {
+		return nil, fmt.Errorf("reading current deployment %s: %v", blueName, err)
+	}
+
+	green := blue.DeepCopy()
+	green.SetName(greenName)
+	green.SetResourceVersion("")
+	if err := unstructured.SetNestedField(green.Object, greenName, "spec", "selector", "matchLabels", SelectorLabel); err != nil {
+		return nil, err
+	}
+	if err := unstructured.SetNestedField(green.Object, greenName, "spec", "template", "metadata", "labels", SelectorLabel); err != nil {
+		return nil, err
+	}
+
+	created, err := client.Create(deploymentsGVR, namespace, green)
+	if err != nil {
+		return nil, fmt.Errorf("creating green deployment %s: %v", greenName, err)
+	}
+	return created, nil
+}
+
+// waitWorkloadReady polls gvr/namespace/name until it reports every
+// desired pod ready, or timeout elapses. Every kind in workloadGVRs
+// except DaemonSet exposes the desired/ready pair as spec.replicas and
+// status.readyReplicas; a DaemonSet has no spec.replicas - the number of
+// pods it wants depends on how many nodes match its node selector - so
+// it's considered ready once every scheduled pod is.
+func waitWorkloadReady(client dynamicClient, gvr schema.GroupVersionResource, namespace, name string, timeout time.Duration) error {
+	return wait.PollImmediate(rolloutPollInterval, timeout, func() (bool, error) {
+		obj, err := client.Get(gvr, namespace, name)
+		if err != nil {
+			return false, err
+		}
+
+		if gvr == daemonSetsGVR {
+			desired, _, _ := unstructured.NestedInt64(obj.Object, "status", "desiredNumberScheduled")
+			ready, _, _ := unstructured.NestedInt64(obj.Object, "status", "numberReady")
+			return ready >= desired, nil
+		}
+
+		replicas, _, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+		readyReplicas, _, _ := unstructured.NestedInt64(obj.Object, "status", "readyReplicas")
+		return readyReplicas >= replicas, nil
+	})
+}
+
+func flipServiceSelector(client dynamicClient, namespace, serviceName string, target *unstructured.Unstructured) error {
+	service, err := client.Get(servicesGVR, namespace, serviceName)
+	if err != nil {
+		return fmt.Errorf("reading service %s: %v", serviceName, err)
+	}
+
+	if err := unstructured.SetNestedField(service.Object, target.GetName(), "spec", "selector", SelectorLabel); err != nil {
+		return err
+	}
+
+	if _, err := client.Update(servicesGVR, namespace, service); err != nil {
+		return fmt.Errorf("flipping selector on service %s to %s: %v", serviceName, target.GetName(), err)
+	}
+	return nil
+}
+
+// replicaSetForDeployment returns the ReplicaSet actually backing
+// deployment, found by listing ReplicaSets with deployment's own
+// selector and taking the most recently created match. Unlike
+// canaryReplicaSets, which compares the newest and second-newest
+// ReplicaSet under a single Deployment mid-canary-rollout, blue and
+// green here are separate Deployments with their own selectors, so only
+// the newest match is relevant.
+func replicaSetForDeployment(client dynamicClient, namespace string, deployment *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	selector, _, _ := unstructured.NestedStringMap(deployment.Object, "spec", "selector", "matchLabels")
+	list, err := client.List(replicaSetsGVR, namespace, selector)
+	if err != nil {
+		return nil, fmt.Errorf("listing replica sets for %s: %v", deployment.GetName(), err)
+	}
+	if len(list) == 0 {
+		return nil, nil
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].GetCreationTimestamp().After(list[j].GetCreationTimestamp().Time)
+	})
+	return list[0], nil
+}
+
+func deleteOldReplicaSetAfterDelay(client dynamicClient, namespace, name string, delay time.Duration) {
+	time.Sleep(delay)
+
+	// name is the blue Deployment's name, not a ReplicaSet's - Kubernetes
+	// auto-names ReplicaSets with a hash suffix - so the actual ReplicaSet
+	// must be looked up via the blue Deployment's selector first.
+	deployment, err := client.Get(deploymentsGVR, namespace, name)
+	if err != nil {
+		logrus.Warnf("failed to read deployment %s/%s to find its old replica set after blue-green cutover: %v", namespace, name, err)
+		return
+	}
+
+	rs, err := replicaSetForDeployment(client, namespace, deployment)
+	if err != nil {
+		logrus.Warnf("failed to find old replica set for %s/%s after blue-green cutover: %v", namespace, name, err)
+		return
+	}
+	if rs == nil {
+		return
+	}
+
+	if err := client.Delete(replicaSetsGVR, namespace, rs.GetName()); err != nil {
+		logrus.Warnf("failed to delete old replica set %s for %s/%s after blue-green cutover: %v", rs.GetName(), namespace, name, err)
+	}
+}
+
+func runCanaryRollout(apiContext *types.APIContext, manager *clustermanager.Manager, id string, data map[string]interface{}) error {
+	steps := parseCanarySteps(data)
+	if len(steps) == 0 {
+		return nil
+	}
+
+	state := getState(data)
+	stepIndex, _ := strconv.Atoi(state[stateKeyCanaryStep])
+	if stepIndex >= len(steps) {
+		stepIndex = len(steps) - 1
+	}
+
+	client, err := rolloutClient(apiContext, manager)
+	if err != nil {
+		return err
+	}
+
+	namespace, name := splitNamespaceAndName(id)
+	if err := setCanaryWeight(client, namespace, name, steps[stepIndex].SetWeight); err != nil {
+		return err
+	}
+
+	state[stateKeyCanaryStep] = strconv.Itoa(stepIndex)
+	setState(data, state)
+	return nil
+}
+
+// setCanaryWeight splits a workload's pods between its stable and canary
+// ReplicaSets by scaling each proportionally to weight, leaving the
+// Deployment's own total replica count untouched: Kubernetes Services
+// don't support weighted routing directly, so the split is realized by
+// how many ready pods of each revision sit behind the shared selector.
+// runCanaryRollout and the promote action handler use it to apply or
+// advance a canary step; abort unwinds a canary via abortCanaryWeight.
+func setCanaryWeight(client dynamicClient, namespace, name string, weight int) error {
+	deployment, err := client.Get(deploymentsGVR, namespace, name)
+	if err != nil {
+		return fmt.Errorf("reading deployment %s for canary weighting: %v", name, err)
+	}
+
+	total, err := ensureStableReplicas(client, deployment)
+	if err != nil {
+		return err
+	}
+
+	newRS, oldRS, err := canaryReplicaSets(client, namespace, deployment)
+	if err != nil {
+		return err
+	}
+
+	newReplicas := (total*int64(weight) + 99) / 100
+	if err := scaleReplicaSet(client, newRS, newReplicas); err != nil {
+		return err
+	}
+	if err := scaleReplicaSet(client, oldRS, total-newReplicas); err != nil {
+		return err
+	}
+
+	return ensureCanaryServiceSelector(client, namespace, name)
+}
+
+// ensureStableReplicas returns the replica count in effect before canary
+// weighting began, recording it on the Deployment (and pausing the
+// Deployment so its own controller doesn't fight the manual ReplicaSet
+// scaling below) the first time a canary weight is applied.
+func ensureStableReplicas(client dynamicClient, deployment *unstructured.Unstructured) (int64, error) {
+	if v, ok, _ := unstructured.NestedString(deployment.Object, "metadata", "annotations", stableReplicasAnnotation); ok && v != "" {
+		total, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parsing %s on %s: %v", stableReplicasAnnotation, deployment.GetName(), err)
+		}
+		return total, nil
+	}
+
+	total, _, _ := unstructured.NestedInt64(deployment.Object, "spec", "replicas")
+	if total == 0 {
+		total = 1
+	}
+
+	if err := unstructured.SetNestedField(deployment.Object, true, "spec", "paused"); err != nil {
+		return 0, err
+	}
+	if err := unstructured.SetNestedField(deployment.Object, strconv.FormatInt(total, 10), "metadata", "annotations", stableReplicasAnnotation); err != nil {
+		return 0, err
+	}
+	if _, err := client.Update(deploymentsGVR, deployment.GetNamespace(), deployment); err != nil {
+		return 0, fmt.Errorf("pausing deployment %s for canary rollout: %v", deployment.GetName(), err)
+	}
+	return total, nil
+}
+
+// canaryReplicaSets returns the Deployment's newest ReplicaSet (the
+// canary) and, if one exists, the next newest (the stable revision being
+// rolled away from).
+func canaryReplicaSets(client dynamicClient, namespace string, deployment *unstructured.Unstructured) (newRS, oldRS *unstructured.Unstructured, err error) {
+	selector, _, _ := unstructured.NestedStringMap(deployment.Object, "spec", "selector", "matchLabels")
+	list, err := client.List(replicaSetsGVR, namespace, selector)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listing replica sets for %s: %v", deployment.GetName(), err)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].GetCreationTimestamp().After(list[j].GetCreationTimestamp().Time)
+	})
+
+	if len(list) > 0 {
+		newRS = list[0]
+	}
+	if len(list) > 1 {
+		oldRS = list[1]
+	}
+	return newRS, oldRS, nil
+}
+
+func scaleReplicaSet(client dynamicClient, rs *unstructured.Unstructured, replicas int64) error {
+	if rs == nil {
+		return nil
+	}
+	if current, _, _ := unstructured.NestedInt64(rs.Object, "spec", "replicas"); current == replicas {
+		return nil
+	}
+	if err := unstructured.SetNestedField(rs.Object, replicas, "spec", "replicas"); err != nil {
+		return err
+	}
+	if _, err := client.Update(replicaSetsGVR, rs.GetNamespace(), rs); err != nil {
+		return fmt.Errorf("scaling replica set %s to %d: %v", rs.GetName(), replicas, err)
+	}
+	return nil
+}
+
+// ensureCanaryServiceSelector makes sure the workload's Service selects by
+// SelectorLabel alone, dropping any other selector keys, so traffic is
+// split purely by how many pods each ReplicaSet above is scaled to. The
+// SelectorLabel value is kept as found: a Service that a previous
+// BlueGreen cutover pointed at a -green Deployment is not pointed back.
+func ensureCanaryServiceSelector(client dynamicClient, namespace, name string) error {
+	service, err := client.Get(servicesGVR, namespace, name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("reading service %s: %v", name, err)
+	}
+
+	workloadID, _, _ := unstructured.NestedString(service.Object, "spec", "selector", SelectorLabel)
+	if workloadID == "" {
+		return nil
+	}
+	if selector, _, _ := unstructured.NestedStringMap(service.Object, "spec", "selector"); len(selector) == 1 {
+		return nil
+	}
+
+	if err := unstructured.SetNestedStringMap(service.Object, map[string]string{SelectorLabel: workloadID}, "spec", "selector"); err != nil {
+		return err
+	}
+	if _, err := client.Update(servicesGVR, namespace, service); err != nil {
+		return fmt.Errorf("resetting selector on service %s for canary rollout: %v", name, err)
+	}
+	return nil
+}
+
+// abortCanaryWeight rolls a canary rollout back: the stable ReplicaSet is
+// restored to the full pre-canary replica count, the canary ReplicaSet is
+// scaled to zero, and the Deployment is unpaused so ordinary updates can
+// be applied again.
+func abortCanaryWeight(client dynamicClient, namespace, name string) error {
+	deployment, err := client.Get(deploymentsGVR, namespace, name)
+	if err != nil {
+		return fmt.Errorf("reading deployment %s to abort canary rollout: %v", name, err)
+	}
+
+	total, err := ensureStableReplicas(client, deployment)
+	if err != nil {
+		return err
+	}
+
+	newRS, oldRS, err := canaryReplicaSets(client, namespace, deployment)
+	if err != nil {
+		return err
+	}
+	if err := scaleReplicaSet(client, newRS, 0); err != nil {
+		return err
+	}
+	if oldRS != nil {
+		if err := scaleReplicaSet(client, oldRS, total); err != nil {
+			return err
+		}
+	} else {
+		// no distinct stable ReplicaSet survived - e.g. abort was called
+		// before the rollout ever split - so restore capacity on newRS.
+		if err := scaleReplicaSet(client, newRS, total); err != nil {
+			return err
+		}
+	}
+
+	if err := unstructured.SetNestedField(deployment.Object, false, "spec", "paused"); err != nil {
+		return err
+	}
+	unstructured.RemoveNestedField(deployment.Object, "metadata", "annotations", stableReplicasAnnotation)
+	if _, err := client.Update(deploymentsGVR, namespace, deployment); err != nil {
+		return fmt.Errorf("unpausing deployment %s after canary abort: %v", name, err)
+	}
+
+	return ensureCanaryServiceSelector(client, namespace, name)
+}
+
+func parseCanarySteps(data map[string]interface{}) []canaryStep {
+	raw, ok := values.GetSlice(data, "deploymentConfig", "strategyConfig", "canary", "steps")
+	if !ok {
+		return nil
+	}
+
+	steps := make([]canaryStep, 0, len(raw))
+	for _, s := range raw {
+		weight, err := convert.ToNumber(s["setWeight"])
+		if err != nil {
+			logrus.Warnf("failed to parse canary step weight %v: %v", s["setWeight"], err)
+		}
+		step := canaryStep{SetWeight: int(weight)}
+		if pause, ok := s["pause"].(map[string]interface{}); ok {
+			step.Pause = &struct {
+				Duration string `json:"duration"`
+			}{Duration: convert.ToString(pause["duration"])}
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+func splitNamespaceAndName(id string) (namespace, name string) {
+	parts := strings.SplitN(id, ":", 2)
+	if len(parts) != 2 {
+		return "", id
+	}
+	return parts[0], parts[1]
+}
+
+// rolloutActionHandler adds the promote/abort actions used to advance or
+// unwind a Canary rollout, falling back to the workload schema's existing
+// handler for every other action.
+type rolloutActionHandler struct {
+	manager *clustermanager.Manager
+	next    func(actionName string, action *types.Action, apiContext *types.APIContext) error
+}
+
+func (h *rolloutActionHandler) ActionHandler(actionName string, action *types.Action, apiContext *types.APIContext) error {
+	switch actionName {
+	case "promote":
+		return h.promote(apiContext)
+	case "abort":
+		return h.abort(apiContext)
+	default:
+		if h.next != nil {
+			return h.next(actionName, action, apiContext)
+		}
+		return httperror.NewAPIError(httperror.ActionNotAvailable, "unknown action "+actionName)
+	}
+}
+
+func (h *rolloutActionHandler) promote(apiContext *types.APIContext) error {
+	data, err := apiContext.Store.ByID(apiContext, apiContext.Schema, apiContext.ID)
+	if err != nil {
+		return err
+	}
+
+	steps := parseCanarySteps(data)
+	if len(steps) == 0 {
+		return httperror.NewAPIError(httperror.InvalidAction, "workload is not running a canary rollout")
+	}
+
+	state := getState(data)
+	stepIndex, _ := strconv.Atoi(state[stateKeyCanaryStep])
+	if stepIndex < len(steps)-1 {
+		stepIndex++
+	}
+
+	client, err := rolloutClient(apiContext, h.manager)
+	if err != nil {
+		return err
+	}
+	namespace, name := splitNamespaceAndName(apiContext.ID)
+	if err := setCanaryWeight(client, namespace, name, steps[stepIndex].SetWeight); err != nil {
+		return err
+	}
+
+	state[stateKeyCanaryStep] = strconv.Itoa(stepIndex)
+	setState(data, state)
+	_, err = apiContext.Store.Update(apiContext, apiContext.Schema, data, apiContext.ID)
+	return err
+}
+
+func (h *rolloutActionHandler) abort(apiContext *types.APIContext) error {
+	data, err := apiContext.Store.ByID(apiContext, apiContext.Schema, apiContext.ID)
+	if err != nil {
+		return err
+	}
+
+	client, err := rolloutClient(apiContext, h.manager)
+	if err != nil {
+		return err
+	}
+	namespace, name := splitNamespaceAndName(apiContext.ID)
+	if err := abortCanaryWeight(client, namespace, name); err != nil {
+		return err
+	}
+
+	state := getState(data)
+	delete(state, stateKeyCanaryStep)
+	setState(data, state)
+	_, err = apiContext.Store.Update(apiContext, apiContext.Schema, data, apiContext.ID)
+	return err
+}
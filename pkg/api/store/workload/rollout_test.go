@@ -0,0 +1,256 @@
+package workload
+
+import (
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// fakeDynamicClient is an in-memory dynamicClient good enough to exercise
+// the BlueGreen/Canary rollout logic in rollout.go without a real cluster.
+type fakeDynamicClient struct {
+	objects []fakeObject
+
+	deletedNames []string
+	updatedNames []string
+}
+
+type fakeObject struct {
+	gvr schema.GroupVersionResource
+	obj *unstructured.Unstructured
+}
+
+func (f *fakeDynamicClient) Get(gvr schema.GroupVersionResource, namespace, name string) (*unstructured.Unstructured, error) {
+	for _, e := range f.objects {
+		if e.gvr == gvr && e.obj.GetNamespace() == namespace && e.obj.GetName() == name {
+			return e.obj.DeepCopy(), nil
+		}
+	}
+	return nil, apierrors.NewNotFound(gvr.GroupResource(), name)
+}
+
+func (f *fakeDynamicClient) List(gvr schema.GroupVersionResource, namespace string, labelSelector map[string]string) ([]*unstructured.Unstructured, error) {
+	var out []*unstructured.Unstructured
+	for _, e := range f.objects {
+		if e.gvr != gvr || e.obj.GetNamespace() != namespace {
+			continue
+		}
+		if !matchesSelector(e.obj.GetLabels(), labelSelector) {
+			continue
+		}
+		out = append(out, e.obj.DeepCopy())
+	}
+	return out, nil
+}
+
+func matchesSelector(labels, selector map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeDynamicClient) Create(gvr schema.GroupVersionResource, namespace string, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	copied := obj.DeepCopy()
+	f.objects = append(f.objects, fakeObject{gvr: gvr, obj: copied})
+	return copied.DeepCopy(), nil
+}
+
+func (f *fakeDynamicClient) Update(gvr schema.GroupVersionResource, namespace string, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	for i, e := range f.objects {
+		if e.gvr == gvr && e.obj.GetNamespace() == namespace && e.obj.GetName() == obj.GetName() {
+			f.updatedNames = append(f.updatedNames, obj.GetName())
+			f.objects[i].obj = obj.DeepCopy()
+			return f.objects[i].obj.DeepCopy(), nil
+		}
+	}
+	return nil, apierrors.NewNotFound(gvr.GroupResource(), obj.GetName())
+}
+
+func (f *fakeDynamicClient) Delete(gvr schema.GroupVersionResource, namespace, name string) error {
+	for i, e := range f.objects {
+		if e.gvr == gvr && e.obj.GetNamespace() == namespace && e.obj.GetName() == name {
+			f.deletedNames = append(f.deletedNames, name)
+			f.objects = append(f.objects[:i], f.objects[i+1:]...)
+			return nil
+		}
+	}
+	return apierrors.NewNotFound(gvr.GroupResource(), name)
+}
+
+func newDeployment(namespace, name string, replicas int64, selector map[string]string) *unstructured.Unstructured {
+	d := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	d.SetAPIVersion("apps/v1")
+	d.SetKind("Deployment")
+	d.SetNamespace(namespace)
+	d.SetName(name)
+	unstructured.SetNestedStringMap(d.Object, selector, "spec", "selector", "matchLabels")
+	unstructured.SetNestedField(d.Object, replicas, "spec", "replicas")
+	return d
+}
+
+func newReplicaSet(namespace, name string, labels map[string]string, replicas int64, createdAt time.Time) *unstructured.Unstructured {
+	rs := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	rs.SetAPIVersion("apps/v1")
+	rs.SetKind("ReplicaSet")
+	rs.SetNamespace(namespace)
+	rs.SetName(name)
+	rs.SetLabels(labels)
+	rs.SetCreationTimestamp(metav1.NewTime(createdAt))
+	unstructured.SetNestedField(rs.Object, replicas, "spec", "replicas")
+	return rs
+}
+
+// TestDeleteOldReplicaSetAfterDelayDeletesTheReplicaSetNotTheDeployment is
+// the regression test for the bug where the delete targeted the blue
+// Deployment's own name - which is never an actual ReplicaSet - instead
+// of the hash-suffixed ReplicaSet it owns.
+func TestDeleteOldReplicaSetAfterDelayDeletesTheReplicaSetNotTheDeployment(t *testing.T) {
+	selector := map[string]string{SelectorLabel: "app"}
+	client := &fakeDynamicClient{objects: []fakeObject{
+		{gvr: deploymentsGVR, obj: newDeployment("ns", "app", 3, selector)},
+		{gvr: replicaSetsGVR, obj: newReplicaSet("ns", "app-7d8f9c6cd9", selector, 3, time.Unix(100, 0))},
+	}}
+
+	deleteOldReplicaSetAfterDelay(client, "ns", "app", 0)
+
+	if len(client.deletedNames) != 1 || client.deletedNames[0] != "app-7d8f9c6cd9" {
+		t.Fatalf("deletedNames = %v, want [app-7d8f9c6cd9]", client.deletedNames)
+	}
+	if _, err := client.Get(deploymentsGVR, "ns", "app"); err != nil {
+		t.Errorf("blue deployment should not have been deleted: %v", err)
+	}
+}
+
+// TestDeleteOldReplicaSetAfterDelayNoOpsWithoutAReplicaSet covers the
+// case where the blue Deployment's ReplicaSet is already gone: nothing
+// should be deleted and no error should propagate out of the goroutine.
+func TestDeleteOldReplicaSetAfterDelayNoOpsWithoutAReplicaSet(t *testing.T) {
+	selector := map[string]string{SelectorLabel: "app"}
+	client := &fakeDynamicClient{objects: []fakeObject{
+		{gvr: deploymentsGVR, obj: newDeployment("ns", "app", 3, selector)},
+	}}
+
+	deleteOldReplicaSetAfterDelay(client, "ns", "app", 0)
+
+	if len(client.deletedNames) != 0 {
+		t.Errorf("deletedNames = %v, want none", client.deletedNames)
+	}
+}
+
+// TestReplicaSetForDeploymentReturnsNewestMatch ensures the blue-green
+// lookup picks the most recently created ReplicaSet under the
+// Deployment's selector when more than one happens to match.
+func TestReplicaSetForDeploymentReturnsNewestMatch(t *testing.T) {
+	selector := map[string]string{SelectorLabel: "app"}
+	deployment := newDeployment("ns", "app", 3, selector)
+	client := &fakeDynamicClient{objects: []fakeObject{
+		{gvr: replicaSetsGVR, obj: newReplicaSet("ns", "app-older", selector, 3, time.Unix(100, 0))},
+		{gvr: replicaSetsGVR, obj: newReplicaSet("ns", "app-newer", selector, 3, time.Unix(200, 0))},
+	}}
+
+	rs, err := replicaSetForDeployment(client, "ns", deployment)
+	if err != nil {
+		t.Fatalf("replicaSetForDeployment: %v", err)
+	}
+	if rs == nil || rs.GetName() != "app-newer" {
+		t.Errorf("got %v, want app-newer", rs)
+	}
+}
+
+// TestCanaryReplicaSetsOrdersNewestAsCanary ensures the proportional
+// traffic split always treats the most recently created ReplicaSet as
+// the canary revision and the next newest as the stable one.
+func TestCanaryReplicaSetsOrdersNewestAsCanary(t *testing.T) {
+	selector := map[string]string{SelectorLabel: "app"}
+	deployment := newDeployment("ns", "app", 10, selector)
+	client := &fakeDynamicClient{objects: []fakeObject{
+		{gvr: replicaSetsGVR, obj: newReplicaSet("ns", "app-stable", selector, 10, time.Unix(100, 0))},
+		{gvr: replicaSetsGVR, obj: newReplicaSet("ns", "app-canary", selector, 0, time.Unix(200, 0))},
+	}}
+
+	newRS, oldRS, err := canaryReplicaSets(client, "ns", deployment)
+	if err != nil {
+		t.Fatalf("canaryReplicaSets: %v", err)
+	}
+	if newRS == nil || newRS.GetName() != "app-canary" {
+		t.Errorf("newRS = %v, want app-canary", newRS)
+	}
+	if oldRS == nil || oldRS.GetName() != "app-stable" {
+		t.Errorf("oldRS = %v, want app-stable", oldRS)
+	}
+}
+
+// TestSetCanaryWeightScalesReplicaSetsProportionally verifies the canary
+// and stable ReplicaSets are scaled to split the Deployment's total
+// replica count by weight, without touching the Deployment's own
+// replica count.
+func TestSetCanaryWeightScalesReplicaSetsProportionally(t *testing.T) {
+	selector := map[string]string{SelectorLabel: "app"}
+	client := &fakeDynamicClient{objects: []fakeObject{
+		{gvr: deploymentsGVR, obj: newDeployment("ns", "app", 10, selector)},
+		{gvr: replicaSetsGVR, obj: newReplicaSet("ns", "app-stable", selector, 10, time.Unix(100, 0))},
+		{gvr: replicaSetsGVR, obj: newReplicaSet("ns", "app-canary", selector, 0, time.Unix(200, 0))},
+		{gvr: servicesGVR, obj: func() *unstructured.Unstructured {
+			svc := &unstructured.Unstructured{Object: map[string]interface{}{}}
+			svc.SetAPIVersion("v1")
+			svc.SetKind("Service")
+			svc.SetNamespace("ns")
+			svc.SetName("app")
+			unstructured.SetNestedStringMap(svc.Object, map[string]string{SelectorLabel: "app"}, "spec", "selector")
+			return svc
+		}()},
+	}}
+
+	if err := setCanaryWeight(client, "ns", "app", 30); err != nil {
+		t.Fatalf("setCanaryWeight: %v", err)
+	}
+
+	canary, err := client.Get(replicaSetsGVR, "ns", "app-canary")
+	if err != nil {
+		t.Fatalf("Get app-canary: %v", err)
+	}
+	if replicas, _, _ := unstructured.NestedInt64(canary.Object, "spec", "replicas"); replicas != 3 {
+		t.Errorf("canary replicas = %d, want 3 (ceil(10*30%%))", replicas)
+	}
+
+	stable, err := client.Get(replicaSetsGVR, "ns", "app-stable")
+	if err != nil {
+		t.Fatalf("Get app-stable: %v", err)
+	}
+	if replicas, _, _ := unstructured.NestedInt64(stable.Object, "spec", "replicas"); replicas != 7 {
+		t.Errorf("stable replicas = %d, want 7", replicas)
+	}
+
+	deployment, err := client.Get(deploymentsGVR, "ns", "app")
+	if err != nil {
+		t.Fatalf("Get app: %v", err)
+	}
+	if total, _, _ := unstructured.NestedInt64(deployment.Object, "spec", "replicas"); total != 10 {
+		t.Errorf("deployment replicas = %d, want unchanged at 10", total)
+	}
+	if paused, _, _ := unstructured.NestedBool(deployment.Object, "spec", "paused"); !paused {
+		t.Error("deployment should have been paused so its controller doesn't fight the manual scaling")
+	}
+}
+
+// TestScaleReplicaSetNoOpsWhenAlreadyAtDesiredReplicas avoids an
+// unnecessary Update call (and the resourceVersion churn it causes) when
+// a ReplicaSet is already scaled to the requested count.
+func TestScaleReplicaSetNoOpsWhenAlreadyAtDesiredReplicas(t *testing.T) {
+	rs := newReplicaSet("ns", "app-stable", nil, 5, time.Unix(100, 0))
+	client := &fakeDynamicClient{objects: []fakeObject{{gvr: replicaSetsGVR, obj: rs}}}
+
+	if err := scaleReplicaSet(client, rs, 5); err != nil {
+		t.Fatalf("scaleReplicaSet: %v", err)
+	}
+	if len(client.updatedNames) != 0 {
+		t.Errorf("updatedNames = %v, want none", client.updatedNames)
+	}
+}
@@ -0,0 +1,173 @@
+package workload
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rancher/norman/types"
+	"github.com/rancher/norman/types/convert"
+	"github.com/rancher/rancher/pkg/api/store/workload/hooks"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Annotations understood by the sync-wave/hook subsystem.
+const (
+	annotationSyncWave         = "workload.cattle.io/sync-wave"
+	annotationHook             = "workload.cattle.io/hook"
+	annotationHookDeletePolicy = "workload.cattle.io/hook-delete-policy"
+
+	syncWaveTimeout = 10 * time.Minute
+	hookJobTimeout  = 10 * time.Minute
+)
+
+var jobsGVR = schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+
+// applySyncWave implements sync-wave ordering and PreSync/Sync/PostSync/
+// SyncFail hooks for CustomizeStore.Create.
+//
+// For a plain workload it blocks until every earlier wave in the
+// namespace has completed, then returns a completion func the caller
+// must invoke, once this workload's own readiness is known, so later
+// waves can proceed. A wave counts as completed once all its members
+// have reported, whether or not they became Ready: a failed earlier wave
+// does not stop later waves from being submitted.
+//
+// For a hook Job (workload.cattle.io/hook set) it runs - or, for
+// PostSync, first waits for every Sync-wave workload submitted so far
+// and then runs - the hook Job inline, enforcing hookDeletePolicy, and
+// returns a no-op completion func since hook Jobs aren't queued as part
+// of the normal wave sequence.
+func (s *CustomizeStore) applySyncWave(apiContext *types.APIContext, schemaID string, data map[string]interface{}) (func(ready bool), error) {
+	annotations := convert.ToMapInterface(data["annotations"])
+	namespace := convert.ToString(data["namespaceId"])
+
+	if hook := hooks.Hook(convert.ToString(annotations[annotationHook])); hook != "" {
+		if !strings.EqualFold(schemaID, "job") {
+			return nil, fmt.Errorf("%s is only supported on Job workloads", annotationHook)
+		}
+		return func(bool) {}, s.runHook(apiContext, namespace, hook, annotations, data)
+	}
+
+	wave := 0
+	if v, ok := annotations[annotationSyncWave]; ok {
+		n, err := strconv.Atoi(convert.ToString(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %v", annotationSyncWave, err)
+		}
+		wave = n
+	}
+
+	complete, err := s.dispatcher.AwaitTurn(namespace, wave, syncWaveTimeout)
+	if err != nil {
+		return nil, err
+	}
+	s.dispatcher.OnWaveFailed(namespace, wave, func() {
+		logrus.Warnf("sync-wave %d in namespace %s reported a failure; any SyncFail hook Jobs defined for it should now run", wave, namespace)
+	})
+
+	return complete, nil
+}
+
+func (s *CustomizeStore) runHook(apiContext *types.APIContext, namespace string, hook hooks.Hook, annotations map[string]interface{}, data map[string]interface{}) error {
+	policy := hooks.DeletePolicy(convert.ToString(annotations[annotationHookDeletePolicy]))
+	if policy == "" {
+		policy = hooks.HookSucceeded
+	}
+
+	switch hook {
+	case hooks.PreSync:
+		return s.runHookJob(apiContext, namespace, data, policy)
+	case hooks.PostSync:
+		if err := s.dispatcher.AwaitAll(namespace, syncWaveTimeout); err != nil {
+			return err
+		}
+		return s.runHookJob(apiContext, namespace, data, policy)
+	case hooks.Sync, hooks.SyncFail:
+		// Sync hooks are left to the normal Create path, which submits
+		// them without waiting on any sync wave; SyncFail hooks only run
+		// once OnWaveFailed fires for the wave they guard.
+		return nil
+	default:
+		return fmt.Errorf("unknown %s value %q", annotationHook, hook)
+	}
+}
+
+func (s *CustomizeStore) runHookJob(apiContext *types.APIContext, namespace string, data map[string]interface{}, policy hooks.DeletePolicy) error {
+	client, err := rolloutClient(apiContext, s.manager)
+	if err != nil {
+		return err
+	}
+
+	name := convert.ToString(data["name"])
+	spec := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": namespace,
+		},
+		"spec": data["jobConfig"],
+	}
+
+	runner := &hooks.Runner{Jobs: &hookJobClient{client: client}, Timeout: hookJobTimeout}
+	return runner.Run(namespace, name, spec, policy)
+}
+
+// awaitReady polls the cluster for the newly created workload to become
+// Ready, up to syncWaveTimeout. Job/CronJob workloads aren't part of the
+// sync-wave readiness gate, since PreSync/PostSync Jobs are run to
+// completion inline by runHookJob instead. Every other kind WithDefaults
+// registers - Deployment, ReplicaSet, ReplicationController, DaemonSet,
+// StatefulSet - is looked up in workloadGVRs so it's polled against its
+// own GVR rather than always assuming Deployment.
+func (s *CustomizeStore) awaitReady(apiContext *types.APIContext, schemaID, namespace, name string) bool {
+	if strings.EqualFold(schemaID, "job") || strings.EqualFold(schemaID, "cronJob") {
+		return true
+	}
+
+	gvr, ok := workloadGVRs[strings.ToLower(schemaID)]
+	if !ok {
+		logrus.Warnf("sync-wave: no readiness check defined for workload kind %s; treating %s/%s as ready", schemaID, namespace, name)
+		return true
+	}
+
+	client, err := rolloutClient(apiContext, s.manager)
+	if err != nil {
+		logrus.Warnf("sync-wave: could not get cluster client to check readiness of %s/%s: %v", namespace, name, err)
+		return false
+	}
+	if err := waitWorkloadReady(client, gvr, namespace, name, syncWaveTimeout); err != nil {
+		logrus.Warnf("sync-wave: %s/%s did not become ready: %v", namespace, name, err)
+		return false
+	}
+	return true
+}
+
+// hookJobClient adapts this package's dynamicClient to hooks.JobClient.
+type hookJobClient struct {
+	client dynamicClient
+}
+
+func (j *hookJobClient) Create(namespace string, spec map[string]interface{}) (string, error) {
+	created, err := j.client.Create(jobsGVR, namespace, &unstructured.Unstructured{Object: spec})
+	if err != nil {
+		return "", err
+	}
+	return created.GetName(), nil
+}
+
+func (j *hookJobClient) Status(namespace, name string) (succeeded, failed bool, err error) {
+	job, err := j.client.Get(jobsGVR, namespace, name)
+	if err != nil {
+		return false, false, err
+	}
+	s, _, _ := unstructured.NestedInt64(job.Object, "status", "succeeded")
+	f, _, _ := unstructured.NestedInt64(job.Object, "status", "failed")
+	return s > 0, f > 0, nil
+}
+
+func (j *hookJobClient) Delete(namespace, name string) error {
+	return j.client.Delete(jobsGVR, namespace, name)
+}
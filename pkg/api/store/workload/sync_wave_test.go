@@ -0,0 +1,71 @@
+package workload
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// TestWaitWorkloadReadyDaemonSetUsesScheduledFields is the regression
+// test for awaitReady hardcoding deploymentsGVR for every workload kind:
+// a DaemonSet has no spec.replicas, so readiness has to be judged from
+// status.desiredNumberScheduled/status.numberReady instead.
+func TestWaitWorkloadReadyDaemonSetUsesScheduledFields(t *testing.T) {
+	ds := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	ds.SetAPIVersion("apps/v1")
+	ds.SetKind("DaemonSet")
+	ds.SetNamespace("ns")
+	ds.SetName("logger")
+	unstructured.SetNestedField(ds.Object, int64(3), "status", "desiredNumberScheduled")
+	unstructured.SetNestedField(ds.Object, int64(3), "status", "numberReady")
+
+	client := &fakeDynamicClient{objects: []fakeObject{{gvr: daemonSetsGVR, obj: ds}}}
+
+	if err := waitWorkloadReady(client, daemonSetsGVR, "ns", "logger", time.Second); err != nil {
+		t.Errorf("waitWorkloadReady: %v", err)
+	}
+}
+
+// TestWaitWorkloadReadyDaemonSetNotReadyUntilAllScheduledPodsReady ensures
+// a DaemonSet with unready pods on some nodes isn't reported ready.
+func TestWaitWorkloadReadyDaemonSetNotReadyUntilAllScheduledPodsReady(t *testing.T) {
+	ds := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	ds.SetAPIVersion("apps/v1")
+	ds.SetKind("DaemonSet")
+	ds.SetNamespace("ns")
+	ds.SetName("logger")
+	unstructured.SetNestedField(ds.Object, int64(3), "status", "desiredNumberScheduled")
+	unstructured.SetNestedField(ds.Object, int64(2), "status", "numberReady")
+
+	client := &fakeDynamicClient{objects: []fakeObject{{gvr: daemonSetsGVR, obj: ds}}}
+
+	if err := waitWorkloadReady(client, daemonSetsGVR, "ns", "logger", 100*time.Millisecond); err == nil {
+		t.Error("expected waitWorkloadReady to time out while a DaemonSet pod is still not ready")
+	}
+}
+
+// TestWaitWorkloadReadyStatefulSetQueriesItsOwnGVR is the other half of
+// the regression: polling a StatefulSet must not read a Deployment of
+// the same name, and must use spec.replicas/status.readyReplicas like
+// every other non-DaemonSet workload kind.
+func TestWaitWorkloadReadyStatefulSetQueriesItsOwnGVR(t *testing.T) {
+	wrongKind := newDeployment("ns", "db", 0, nil) // would report not-ready if read by mistake
+
+	sts := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	sts.SetAPIVersion("apps/v1")
+	sts.SetKind("StatefulSet")
+	sts.SetNamespace("ns")
+	sts.SetName("db")
+	unstructured.SetNestedField(sts.Object, int64(3), "spec", "replicas")
+	unstructured.SetNestedField(sts.Object, int64(3), "status", "readyReplicas")
+
+	client := &fakeDynamicClient{objects: []fakeObject{
+		{gvr: deploymentsGVR, obj: wrongKind},
+		{gvr: statefulSetsGVR, obj: sts},
+	}}
+
+	if err := waitWorkloadReady(client, statefulSetsGVR, "ns", "db", time.Second); err != nil {
+		t.Errorf("waitWorkloadReady: %v", err)
+	}
+}
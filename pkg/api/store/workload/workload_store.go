@@ -3,7 +3,6 @@ package workload
 import (
 	"encoding/json"
 	"fmt"
-	"strconv"
 	"strings"
 
 	"github.com/docker/distribution/reference"
@@ -13,6 +12,7 @@ import (
 	"github.com/rancher/norman/types/convert"
 	"github.com/rancher/norman/types/values"
 	"github.com/rancher/rancher/pkg/api/customization/workload"
+	"github.com/rancher/rancher/pkg/api/store/workload/hooks"
 	"github.com/rancher/rancher/pkg/clustermanager"
 	managementschema "github.com/rancher/types/apis/management.cattle.io/v3/schema"
 	"github.com/rancher/types/apis/project.cattle.io/v3/schema"
@@ -23,19 +23,29 @@ import (
 	corev1 "k8s.io/api/core/v1"
 )
 
+// NewWorkloadAggregateStore wires the "workload" schema to the aggregate
+// store using Rancher's built-in workload kinds and formatters. It is a
+// thin wrapper around New for existing callers; new code should call New
+// directly and layer additional Options (WithSchema, WithFormatter, ...)
+// on top of WithDefaults.
 func NewWorkloadAggregateStore(schemas *types.Schemas, manager *clustermanager.Manager) {
+	New(schemas, manager, WithDefaults(schemas))
+}
+
+// New wires the "workload" schema to an aggregate store built from
+// opts - normally WithDefaults(schemas) plus any combination of
+// WithSchema, WithFormatter and WithActionHandler - so that a custom
+// subsystem (e.g. a future virtualMachineInstance kind) can plug into
+// the aggregate workload store without forking this package.
+func New(schemas *types.Schemas, manager *clustermanager.Manager, opts ...Option) {
+	c := newConfig(opts)
+
 	workloadSchema := schemas.Schema(&schema.Version, "workload")
-	store := NewAggregateStore(schemas.Schema(&schema.Version, "deployment"),
-		schemas.Schema(&schema.Version, "replicaSet"),
-		schemas.Schema(&schema.Version, "replicationController"),
-		schemas.Schema(&schema.Version, "daemonSet"),
-		schemas.Schema(&schema.Version, "statefulSet"),
-		schemas.Schema(&schema.Version, "job"),
-		schemas.Schema(&schema.Version, "cronJob"))
+	store := NewAggregateStore(c.schemas...)
 
 	for _, s := range store.Schemas {
-		if s.ID == "deployment" {
-			s.Formatter = workload.DeploymentFormatter
+		if fn, ok := c.formatters[s.ID]; ok {
+			s.Formatter = fn
 		} else {
 			s.Formatter = workload.Formatter
 		}
@@ -45,40 +55,171 @@ func NewWorkloadAggregateStore(schemas *types.Schemas, manager *clustermanager.M
 	actionWrapper := workload.ActionWrapper{
 		ClusterManager: manager,
 	}
-	workloadSchema.ActionHandler = actionWrapper.ActionHandler
+	next := actionWrapper.ActionHandler
+	if c.actionHandler != nil {
+		next = c.actionHandler
+	}
+	rolloutHandler := &rolloutActionHandler{
+		manager: manager,
+		next:    next,
+	}
+	workloadSchema.ActionHandler = rolloutHandler.ActionHandler
 	workloadSchema.LinkHandler = workload.Handler{}.LinkHandler
+	if workloadSchema.ResourceActions == nil {
+		workloadSchema.ResourceActions = map[string]types.Action{}
+	}
+	workloadSchema.ResourceActions["promote"] = types.Action{}
+	workloadSchema.ResourceActions["abort"] = types.Action{}
 }
 
-func NewCustomizeStore(store types.Store) types.Store {
+// NewCustomizeStore wraps store with Rancher's workload customizations.
+// Pass WithPortNamer/WithCredentialResolver to override the historical
+// port-naming scheme or docker-credential lookup used by setPorts and
+// setSecrets/resolveImages; both default to Rancher's built-in behavior.
+func NewCustomizeStore(store types.Store, manager *clustermanager.Manager, opts ...Option) types.Store {
+	return newCustomizeStore(store, manager, newConfig(opts))
+}
+
+func newCustomizeStore(store types.Store, manager *clustermanager.Manager, c *config) *CustomizeStore {
 	return &CustomizeStore{
-		Store: NewTransformStore(store),
+		Store:              NewTransformStore(store),
+		resolver:           c.resolver,
+		manager:            manager,
+		dispatcher:         hooks.NewDispatcher(),
+		portNamer:          c.portNamer,
+		credentialResolver: c.credentialResolver,
+		registryAuth:       c.registryAuth,
 	}
 }
 
 type CustomizeStore struct {
 	types.Store
+	resolver           registryResolver
+	manager            *clustermanager.Manager
+	dispatcher         *hooks.Dispatcher
+	portNamer          PortNamer
+	credentialResolver CredentialResolver
+	registryAuth       RegistryAuthResolver
 }
 
-func (s *CustomizeStore) Create(apiContext *types.APIContext, schema *types.Schema, data map[string]interface{}) (map[string]interface{}, error) {
+func (s *CustomizeStore) Create(apiContext *types.APIContext, schema *types.Schema, data map[string]interface{}) (result map[string]interface{}, err error) {
 	setSelector(schema.ID, data)
 	setWorkloadSpecificDefaults(schema.ID, data)
-	setSecrets(apiContext, data)
-	if err := setPorts(convert.ToString(data["name"]), data); err != nil {
+
+	complete, err := s.applySyncWave(apiContext, schema.ID, data)
+	if err != nil {
+		return nil, err
+	}
+	if complete != nil {
+		defer func() {
+			if err != nil {
+				complete(false)
+			}
+		}()
+	}
+
+	if err = s.resolveImages(apiContext, data); err != nil {
+		return nil, err
+	}
+	s.setSecrets(apiContext, data)
+	if err = s.setPorts(convert.ToString(data["name"]), data); err != nil {
 		return nil, err
 	}
 	setScheduling(apiContext, data)
-	setStrategy(data)
-	return s.Store.Create(apiContext, schema, data)
+	if err = applyStrategy(apiContext, s.manager, "", data); err != nil {
+		return nil, err
+	}
+
+	result, err = s.Store.Create(apiContext, schema, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if complete != nil {
+		namespace := convert.ToString(data["namespaceId"])
+		name := convert.ToString(data["name"])
+		go func() {
+			complete(s.awaitReady(apiContext, schema.ID, namespace, name))
+		}()
+	}
+
+	return result, nil
 }
 
 func (s *CustomizeStore) Update(apiContext *types.APIContext, schema *types.Schema, data map[string]interface{}, id string) (map[string]interface{}, error) {
 	splitted := strings.Split(id, ":")
-	if err := setPorts(splitted[1], data); err != nil {
-		return nil, err
+	return s.update(apiContext, schema, splitted, id, data)
+}
+
+// resolveImages pins each container's image to a concrete digest according
+// to the workload's imageResolutionPolicy (defaulting to IfNotPinned), and
+// records the original tag->digest mapping on ResolvedDigestsAnnotation.
+func (s *CustomizeStore) resolveImages(apiContext *types.APIContext, data map[string]interface{}) error {
+	policy := convert.ToString(data["imageResolutionPolicy"])
+	if policy == "" {
+		policy = ImageResolutionIfNotPinned
 	}
-	setScheduling(apiContext, data)
-	setStrategy(data)
-	return s.Store.Update(apiContext, schema, data, id)
+	if policy == ImageResolutionNever || s.resolver == nil {
+		return nil
+	}
+
+	containers, ok := values.GetSlice(data, "containers")
+	if !ok {
+		return nil
+	}
+
+	domainToCreds := s.credentialResolver(apiContext, convert.ToString(data["namespaceId"]))
+	resolved := map[string]string{}
+
+	for _, container := range containers {
+		image := convert.ToString(container["image"])
+		if image == "" {
+			continue
+		}
+
+		named, err := reference.ParseNormalizedNamed(image)
+		if err != nil {
+			logrus.Debugf("skipping image resolution for %v: %v", image, err)
+			continue
+		}
+		if _, ok := named.(reference.Digested); ok {
+			continue
+		}
+		if policy == ImageResolutionIfNotPinned && strings.Contains(image, "@sha256:") {
+			continue
+		}
+
+		tag := "latest"
+		if tagged, ok := reference.TagNameOnly(named).(reference.Tagged); ok {
+			tag = tagged.Tag()
+		}
+
+		domain := getDomain(image)
+		credentialName := ""
+		if secrets, ok := domainToCreds[domain]; ok && len(secrets) > 0 {
+			credentialName = secrets[0].Name
+		}
+		username, password := s.registryAuth(apiContext, credentialName, domain)
+
+		digest, err := s.resolver.ResolveDigest(domain, reference.Path(named), tag, username, password)
+		if err != nil {
+			logrus.Warnf("failed to resolve digest for image %v: %v", image, err)
+			continue
+		}
+
+		container["image"] = fmt.Sprintf("%s@%s", named.Name(), digest)
+		resolved[image] = digest
+	}
+
+	if len(resolved) > 0 {
+		content, err := json.Marshal(resolved)
+		if err != nil {
+			return err
+		}
+		values.PutValue(data, string(content), "annotations", ResolvedDigestsAnnotation)
+	}
+
+	return nil
 }
 
 func (s *CustomizeStore) ByID(apiContext *types.APIContext, schema *types.Schema, id string) (map[string]interface{}, error) {
@@ -101,14 +242,6 @@ func setScheduling(apiContext *types.APIContext, data map[string]interface{}) {
 	}
 }
 
-func setStrategy(data map[string]interface{}) {
-	strategy, ok := values.GetValue(data, "deploymentConfig", "strategy")
-	if ok && convert.ToString(strategy) == "Recreate" {
-		values.RemoveValue(data, "deploymentConfig", "maxSurge")
-		values.RemoveValue(data, "deploymentConfig", "maxUnavailable")
-	}
-}
-
 func setSelector(schemaID string, data map[string]interface{}) {
 	setSelector := false
 	isJob := strings.EqualFold(schemaID, "job") || strings.EqualFold(schemaID, "cronJob")
@@ -142,13 +275,13 @@ func setSelector(schemaID string, data map[string]interface{}) {
 	}
 }
 
-func setSecrets(apiContext *types.APIContext, data map[string]interface{}) {
+func (s *CustomizeStore) setSecrets(apiContext *types.APIContext, data map[string]interface{}) {
 	if val, _ := values.GetValue(data, "imagePullSecrets"); val != nil {
 		return
 	}
 	if containers, _ := values.GetSlice(data, "containers"); len(containers) > 0 {
 		imagePullSecrets, _ := data["imagePullSecrets"].([]corev1.LocalObjectReference)
-		domainToCreds := getCreds(apiContext, convert.ToString(data["namespaceId"]))
+		domainToCreds := s.credentialResolver(apiContext, convert.ToString(data["namespaceId"]))
 		for _, container := range containers {
 			if image := convert.ToString(container["image"]); image != "" {
 				domain := getDomain(image)
@@ -172,7 +305,7 @@ func setWorkloadSpecificDefaults(schemaID string, data map[string]interface{}) {
 	}
 }
 
-func setPorts(workloadName string, data map[string]interface{}) error {
+func (s *CustomizeStore) setPorts(workloadName string, data map[string]interface{}) error {
 	containers, ok := values.GetValue(data, "containers")
 	if !ok {
 		return nil
@@ -201,22 +334,8 @@ func setPorts(workloadName string, data map[string]interface{}) error {
 					if err != nil {
 						logrus.Warnf("Failed to transform container port [%v] to number: %v", port["containerPort"], err)
 					}
-					// port name is of format containerPortProtoSourcePortKind
-					// len limit is 15, therefore a) no separator b) kind is numerated
-					numKind := 0
-					switch kind := convert.ToString(port["kind"]); kind {
-					case "NodePort":
-						numKind = 1
-					case "ClusterIP":
-						numKind = 2
-					case "LoadBalancer":
-						numKind = 3
-					}
-
-					portName = fmt.Sprintf("%s%s%s%s", strconv.Itoa(int(containerPort)),
-						strings.ToLower(convert.ToString(port["protocol"])),
-						strings.ToLower(convert.ToString(port["sourcePort"])),
-						strings.ToLower(convert.ToString(numKind)))
+					portName = s.portNamer(int64(containerPort), convert.ToString(port["protocol"]),
+						convert.ToString(port["sourcePort"]), convert.ToString(port["kind"]))
 				} else {
 					portName = convert.ToString(port["name"])
 				}
@@ -274,6 +393,39 @@ func getCreds(apiContext *types.APIContext, namespaceID string) map[string][]cor
 	return domainToCreds
 }
 
+// getRegistryAuth is the default RegistryAuthResolver: it looks up the
+// named dockerCredential or namespacedDockerCredential resource and
+// returns the username/password registered for domain, if any.
+func getRegistryAuth(apiContext *types.APIContext, credentialName, domain string) (username, password string) {
+	if credentialName == "" {
+		return "", ""
+	}
+
+	var namespacedCreds []projectclient.NamespacedDockerCredential
+	if err := access.List(apiContext, &projectschema.Version, "namespacedDockerCredential", &types.QueryOptions{}, &namespacedCreds); err == nil {
+		for _, cred := range namespacedCreds {
+			if cred.Name == credentialName {
+				if reg, ok := cred.Registries[domain]; ok {
+					return reg.Username, reg.Password
+				}
+			}
+		}
+	}
+
+	var creds []projectclient.DockerCredential
+	if err := access.List(apiContext, &projectschema.Version, "dockerCredential", &types.QueryOptions{}, &creds); err == nil {
+		for _, cred := range creds {
+			if cred.Name == credentialName {
+				if reg, ok := cred.Registries[domain]; ok {
+					return reg.Username, reg.Password
+				}
+			}
+		}
+	}
+
+	return "", ""
+}
+
 func getNodeName(apiContext *types.APIContext, nodeID string) string {
 	var node managementv3.Node
 	var nodeName string